@@ -0,0 +1,154 @@
+package pforward
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestFromClient(t *testing.T) {
+	lan := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 10.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	other := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 1.1.1.1"))
+		w.WriteMsg(ret)
+	})
+
+	path := filepath.Join(t.TempDir(), "clients")
+	if err := os.WriteFile(path, []byte("# office\n192.168.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from     string
+		writer   dns.ResponseWriter
+		expected string
+	}{
+		{"10.240.0.0/16", &test.ResponseWriter{}, "10.0.0.1"},
+		{"10.240.0.1", &test.ResponseWriter{}, "10.0.0.1"},
+		{"192.168.0.0/16 10.0.0.0/8", &test.ResponseWriter{}, "10.0.0.1"},
+		{"fe80::/10", &test.ResponseWriter6{}, "10.0.0.1"},
+		{"fe80::/10", &test.ResponseWriter{}, "1.1.1.1"},
+		{"172.16.0.0/12", &test.ResponseWriter{}, "1.1.1.1"},
+		{path, &test.ResponseWriter{}, "1.1.1.1"},
+		{path + " 10.240.0.0/24", &test.ResponseWriter{}, "10.0.0.1"},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward . "+lan+" {\nfrom_client "+tc.from+"\n}\npforward . "+other)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		fs[0].Next = fs[1]
+		for _, f := range fs {
+			f.OnStartup()
+			defer f.OnShutdown()
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(tc.writer)
+		if _, err := fs[0].ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but didn't: %v", i, err)
+		}
+		if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, ip)
+		}
+	}
+}
+
+func TestFromClientReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients")
+	if err := os.WriteFile(path, []byte("192.168.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\nreload 0\nfrom_client "+path+" 172.16.0.1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	if f.clientWatcher == nil || f.clientWatcher.interval != 0 {
+		t.Fatalf("expected a client watcher without polling, got %+v", f.clientWatcher)
+	}
+
+	state := func(ip string) bool {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		return f.match(request.Request{W: &test.ResponseWriter{RemoteIP: ip}, Req: m})
+	}
+	if !state("192.168.1.1") || !state("172.16.0.1") || state("10.0.0.1") {
+		t.Fatalf("unexpected client set before reload")
+	}
+
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := f.clientWatcher.reload(); !changed || err != nil {
+		t.Fatalf("expected changed file to build, changed=%v err=%v", changed, err)
+	}
+	if state("192.168.1.1") || !state("172.16.0.1") || !state("10.0.0.1") {
+		t.Errorf("unexpected client set after reload")
+	}
+
+	// a broken file keeps the live set
+	if err := os.WriteFile(path, []byte("# nothing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.clientWatcher.reload(); err == nil {
+		t.Errorf("expected an empty file to fail")
+	}
+	if !state("10.0.0.1") {
+		t.Errorf("expected the previous client set to stay")
+	}
+}
+
+func TestFromClientParse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clients")
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"pforward . 127.0.0.1 {\nfrom_client 10.0.0.0/8 ::1\n}", false},
+		{"pforward . 127.0.0.1 {\nfrom_client " + path + "\nreload 10s\n}", false},
+		{"pforward . 127.0.0.1 {\nreload 10s\nfrom_client " + path + "\n}", false},
+		{"pforward . 127.0.0.1 {\nfrom_client\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client 10.0.0.0/33\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client " + dir + "\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client " + path + " " + path + "\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client " + empty + "\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client 10.0.0.0/8\nreload 10s\n}", true},
+		{"pforward . 127.0.0.1 {\nreload 10s\nfrom_client 10.0.0.0/8\n}", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+	}
+}
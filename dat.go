@@ -0,0 +1,277 @@
+package pforward
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// v2ray compiles its domain and IP lists into protobuf files, geosite.dat and geoip.dat, holding a list of
+// named entries each. They are referenced as "geosite:PATH:NAME[@attr]..." and "geoip:PATH:NAME".
+const (
+	geositePrefix = "geosite:"
+	geoipPrefix   = "geoip:"
+)
+
+// Field numbers of GeoSiteList, GeoSite, Domain and Domain.Attribute.
+const (
+	geositeEntry    protowire.Number = 1
+	geositeCode     protowire.Number = 1
+	geositeDomain   protowire.Number = 2
+	domainType      protowire.Number = 1
+	domainValue     protowire.Number = 2
+	domainAttribute protowire.Number = 3
+	attributeKey    protowire.Number = 1
+)
+
+// Field numbers of GeoIPList, GeoIP and CIDR.
+const (
+	geoipEntry   protowire.Number = 1
+	geoipCode    protowire.Number = 1
+	geoipCIDR    protowire.Number = 2
+	geoipReverse protowire.Number = 3
+	cidrIP       protowire.Number = 1
+	cidrPrefix   protowire.Number = 2
+)
+
+// Domain.Type values.
+const (
+	domainTypePlain  = 0 // keyword
+	domainTypeRegex  = 1
+	domainTypeDomain = 2 // the domain and its subdomains
+	domainTypeFull   = 3
+)
+
+// datSpec is a reference to one entry of a dat file. Domains of a geosite entry can be filtered by their
+// attributes, "@ads" keeps only domains with the attribute and "@!ads" only those without it.
+type datSpec struct {
+	path  string
+	name  string
+	attrs map[string]bool // attribute -> wanted
+}
+
+// parseDatSpec parses s without its prefix, the name is the part after the last colon.
+func parseDatSpec(s string) (*datSpec, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 || i == len(s)-1 {
+		return nil, fmt.Errorf("invalid dat reference '%s', expected PATH:NAME", s)
+	}
+
+	spec := &datSpec{path: s[:i], attrs: make(map[string]bool)}
+	name, attrs, ok := strings.Cut(s[i+1:], "@")
+	spec.name = name
+	if ok {
+		for _, attr := range strings.Split(attrs, "@") {
+			key, exclude := strings.CutPrefix(attr, "!")
+			if key == "" {
+				return nil, fmt.Errorf("invalid attribute in '%s'", s)
+			}
+			spec.attrs[strings.ToLower(key)] = !exclude
+		}
+	}
+	if spec.name == "" {
+		return nil, fmt.Errorf("invalid dat reference '%s', expected PATH:NAME", s)
+	}
+	return spec, nil
+}
+
+// entry returns the entry called name from a list encoded as repeated field num, the name being field code
+// of the entry. Names are compared case-insensitively as v2ray does.
+func (spec *datSpec) entry(files rulesetFiles, num, code protowire.Number) ([]byte, error) {
+	path := filepath.Clean(spec.path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path=%s err=%v", path, err)
+	}
+	files[path] = sha256.Sum256(data)
+
+	var found []byte
+	err = walkProto(data, func(n protowire.Number, entry []byte, _ uint64) error {
+		if n != num || found != nil {
+			return nil
+		}
+		return walkProto(entry, func(n protowire.Number, name []byte, _ uint64) error {
+			if n == code && strings.EqualFold(string(name), spec.name) {
+				found = entry
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid dat file %s: %v", path, err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no list '%s' in %s", spec.name, path)
+	}
+	return found, nil
+}
+
+// readGeosite reads the rules of a geosite entry, spec is "PATH:NAME[@attr]...".
+func readGeosite(s string, files rulesetFiles) ([]Rule, error) {
+	spec, err := parseDatSpec(s)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := spec.entry(files, geositeEntry, geositeCode)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]Rule, 0)
+	err = walkProto(entry, func(n protowire.Number, domain []byte, _ uint64) error {
+		if n != geositeDomain {
+			return nil
+		}
+
+		typ, value, attrs := uint64(domainTypePlain), "", make(map[string]bool)
+		err := walkProto(domain, func(n protowire.Number, b []byte, v uint64) error {
+			switch n {
+			case domainType:
+				typ = v
+			case domainValue:
+				value = string(b)
+			case domainAttribute:
+				return walkProto(b, func(n protowire.Number, key []byte, _ uint64) error {
+					if n == attributeKey {
+						attrs[strings.ToLower(string(key))] = true
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for attr, wanted := range spec.attrs {
+			if attrs[attr] != wanted {
+				return nil
+			}
+		}
+
+		var prefix string
+		switch typ {
+		case domainTypePlain:
+			prefix = rulePrefixes[RuleKeyword]
+		case domainTypeRegex:
+			prefix = rulePrefixes[RuleRegexp]
+		case domainTypeDomain:
+			prefix = rulePrefixes[RuleDomain]
+		case domainTypeFull:
+			prefix = rulePrefixes[RuleFull]
+		default:
+			return fmt.Errorf("unknown domain type %d of '%s'", typ, value)
+		}
+		subrules, err := parseRule(prefix + value)
+		if err != nil {
+			return fmt.Errorf("invalid rule '%s': %v", prefix+value, err)
+		}
+		rules = append(rules, subrules...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid list '%s' in %s: %v", spec.name, spec.path, err)
+	}
+
+	return rules, nil
+}
+
+// readGeoIP reads the networks of a geoip entry, spec is "PATH:NAME".
+func readGeoIP(s string, files rulesetFiles) ([]netip.Prefix, error) {
+	spec, err := parseDatSpec(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.attrs) > 0 {
+		return nil, fmt.Errorf("invalid dat reference '%s', attributes are only supported for geosite", s)
+	}
+	entry, err := spec.entry(files, geoipEntry, geoipCode)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]netip.Prefix, 0)
+	err = walkProto(entry, func(n protowire.Number, cidr []byte, v uint64) error {
+		if n == geoipReverse && v != 0 {
+			return fmt.Errorf("reverse_match is not supported")
+		}
+		if n != geoipCIDR {
+			return nil
+		}
+
+		var ip []byte
+		var bits uint64
+		err := walkProto(cidr, func(n protowire.Number, b []byte, v uint64) error {
+			switch n {
+			case cidrIP:
+				ip = b
+			case cidrPrefix:
+				bits = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || bits > uint64(addr.BitLen()) {
+			return fmt.Errorf("invalid cidr %v/%d", ip, bits)
+		}
+		if addr.Is4In6() && bits >= 96 {
+			addr, bits = addr.Unmap(), bits-96
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, int(bits)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid list '%s' in %s: %v", spec.name, spec.path, err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no cidr found in list '%s' of %s", spec.name, spec.path)
+	}
+
+	return prefixes, nil
+}
+
+// walkProto calls fn for every field of the message b, with the content of length-delimited fields or the
+// value of varint fields. Other fields are skipped.
+func walkProto(b []byte, fn func(num protowire.Number, data []byte, v uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var err error
+		switch typ {
+		case protowire.BytesType:
+			var data []byte
+			data, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				err = fn(num, data, 0)
+			}
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				err = fn(num, nil, v)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
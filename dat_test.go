@@ -0,0 +1,218 @@
+package pforward
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testDomain struct {
+	typ   uint64
+	value string
+	attrs []string
+}
+
+// writeGeosite writes a geosite.dat with the given lists.
+func writeGeosite(t *testing.T, path string, lists map[string][]testDomain) {
+	var data []byte
+	for code, domains := range lists {
+		var entry []byte
+		entry = protowire.AppendTag(entry, geositeCode, protowire.BytesType)
+		entry = protowire.AppendString(entry, code)
+		for _, d := range domains {
+			var domain []byte
+			domain = protowire.AppendTag(domain, domainType, protowire.VarintType)
+			domain = protowire.AppendVarint(domain, d.typ)
+			domain = protowire.AppendTag(domain, domainValue, protowire.BytesType)
+			domain = protowire.AppendString(domain, d.value)
+			for _, attr := range d.attrs {
+				var a []byte
+				a = protowire.AppendTag(a, attributeKey, protowire.BytesType)
+				a = protowire.AppendString(a, attr)
+				a = protowire.AppendTag(a, 2, protowire.VarintType) // bool_value
+				a = protowire.AppendVarint(a, 1)
+				domain = protowire.AppendTag(domain, domainAttribute, protowire.BytesType)
+				domain = protowire.AppendBytes(domain, a)
+			}
+			entry = protowire.AppendTag(entry, geositeDomain, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, domain)
+		}
+		data = protowire.AppendTag(data, geositeEntry, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeGeoIP writes a geoip.dat with the given lists.
+func writeGeoIP(t *testing.T, path string, lists map[string][]string) {
+	var data []byte
+	for code, cidrs := range lists {
+		var entry []byte
+		entry = protowire.AppendTag(entry, geoipCode, protowire.BytesType)
+		entry = protowire.AppendString(entry, code)
+		for _, s := range cidrs {
+			prefix := netip.MustParsePrefix(s)
+			var cidr []byte
+			cidr = protowire.AppendTag(cidr, cidrIP, protowire.BytesType)
+			cidr = protowire.AppendBytes(cidr, prefix.Addr().AsSlice())
+			cidr = protowire.AppendTag(cidr, cidrPrefix, protowire.VarintType)
+			cidr = protowire.AppendVarint(cidr, uint64(prefix.Bits()))
+			entry = protowire.AppendTag(entry, geoipCIDR, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, cidr)
+		}
+		data = protowire.AppendTag(data, geoipEntry, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeosite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	writeGeosite(t, path, map[string][]testDomain{
+		"CN": {{domainTypeDomain, "baidu.com", nil}},
+		"GEOLOCATION-!CN": {
+			{domainTypeDomain, "google.com", nil},
+			{domainTypeFull, "www.youtube.com", nil},
+			{domainTypePlain, "twitter", nil},
+			{domainTypeRegex, `^ads?\d+\.example\.net$`, []string{"ads"}},
+			{domainTypeDomain, "doubleclick.net", []string{"ads", "cn"}},
+		},
+	})
+
+	tests := []struct {
+		list     string
+		name     string
+		expected bool
+	}{
+		{"geolocation-!cn", "mail.google.com.", true},
+		{"geolocation-!cn", "www.youtube.com.", true},
+		{"geolocation-!cn", "m.youtube.com.", false},
+		{"geolocation-!cn", "api.twitter.com.", true},
+		{"geolocation-!cn", "ads1.example.net.", true},
+		{"geolocation-!cn", "baidu.com.", false},
+		{"cn", "www.baidu.com.", true},
+		{"geolocation-!cn@ads", "ads1.example.net.", true},
+		{"geolocation-!cn@ads", "doubleclick.net.", true},
+		{"geolocation-!cn@ads", "google.com.", false},
+		{"geolocation-!cn@ads@!cn", "doubleclick.net.", false},
+		{"geolocation-!cn@ads@!cn", "ads1.example.net.", true},
+		{"geolocation-!cn@!ads", "google.com.", true},
+		{"geolocation-!cn@!ads", "doubleclick.net.", false},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward geosite:"+path+":"+tc.list+" 127.0.0.1")
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		if matched := fs[0].from.Load().Match(tc.name); matched != tc.expected {
+			t.Errorf("Test %d: expected %s in %s to be %t", i, tc.name, tc.list, tc.expected)
+		}
+	}
+}
+
+func TestGeositeReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	writeGeosite(t, path, map[string][]testDomain{"CN": {{domainTypeDomain, "baidu.com", nil}}})
+
+	c := caddy.NewTestController("dns", "pforward geosite:"+path+":cn 127.0.0.1 {\nexcept qq.com\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	if w := f.watcher.watched(); len(w) != 1 || filepath.Base(w[0]) != "geosite.dat" {
+		t.Fatalf("expected geosite.dat to be watched, got %v", w)
+	}
+
+	writeGeosite(t, path, map[string][]testDomain{"CN": {{domainTypeDomain, "qq.com", nil}, {domainTypeDomain, "163.com", nil}}})
+	if changed, err := f.watcher.reload(); !changed || err != nil {
+		t.Fatalf("expected changed file to build, changed=%v err=%v", changed, err)
+	}
+	from := f.from.Load()
+	if from.Match("baidu.com.") || !from.Match("163.com.") || from.Match("qq.com.") {
+		t.Errorf("unexpected rules after reload: %v", from.Format())
+	}
+}
+
+func TestGeoIPDat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.dat")
+	writeGeoIP(t, path, map[string][]string{
+		"CN":      {"1.0.1.0/24", "240e::/20", "::ffff:36.0.0.0/110"},
+		"PRIVATE": {"10.0.0.0/8"},
+	})
+
+	prefixes, err := readPrefixes(geoipPrefix+path+":cn", rulesetFiles{})
+	if err != nil {
+		t.Fatalf("Failed to read geoip.dat: %s", err)
+	}
+	trie := newIPTrie(prefixes)
+	for addr, expected := range map[string]bool{
+		"1.0.1.1":    true,
+		"240e::1":    true,
+		"36.0.0.1":   true,
+		"10.0.0.1":   false,
+		"1.0.2.1":    false,
+		"2001:db8::": false,
+	} {
+		if trie.Contains(netip.MustParseAddr(addr)) != expected {
+			t.Errorf("expected %s inside to be %t", addr, expected)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\nfrom_client geoip:"+path+":private\ngeoip geoip:"+path+":cn\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if !fs[0].clients.Load().Contains(netip.MustParseAddr("10.1.1.1")) {
+		t.Errorf("expected the private list as clients")
+	}
+	if !fs[0].geoip.cidrs.Contains(netip.MustParseAddr("1.0.1.1")) {
+		t.Errorf("expected the cn list for geoip")
+	}
+}
+
+func TestDatParse(t *testing.T) {
+	dir := t.TempDir()
+	geosite := filepath.Join(dir, "geosite.dat")
+	writeGeosite(t, geosite, map[string][]testDomain{"CN": {{domainTypeDomain, "baidu.com", nil}}})
+	geoip := filepath.Join(dir, "geoip.dat")
+	writeGeoIP(t, geoip, map[string][]string{"CN": {"1.0.1.0/24"}})
+	broken := filepath.Join(dir, "broken.dat")
+	if err := os.WriteFile(broken, []byte{0x0a, 0xff}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"pforward geosite:" + geosite + ":CN 127.0.0.1", false},
+		{"pforward geosite:" + geosite + ":us 127.0.0.1", true},
+		{"pforward geosite:" + geosite + " 127.0.0.1", true},
+		{"pforward geosite:" + geosite + ": 127.0.0.1", true},
+		{"pforward geosite:" + geosite + ":cn@ 127.0.0.1", true},
+		{"pforward geosite:" + broken + ":cn 127.0.0.1", true},
+		{"pforward geosite:" + dir + "/missing.dat:cn 127.0.0.1", true},
+		{"pforward . 127.0.0.1 {\ngeoip geoip:" + geoip + ":cn\n}", false},
+		{"pforward . 127.0.0.1 {\ngeoip geoip:" + geoip + ":us\n}", true},
+		{"pforward . 127.0.0.1 {\ngeoip geoip:" + geoip + ":cn@ads\n}", true},
+		{"pforward . 127.0.0.1 {\nfrom_client geoip:" + broken + ":cn\n}", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package pforward
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// dialProxy is an upstream speaking plain DNS or DNS over TLS over connections from dial. It stands in
+// for proxy.Proxy, which always dials directly, when the stanza has an egress. Idle connections are kept
+// for reuse until expire, up to maxIdleConns per protocol.
+type dialProxy struct {
+	upstreamHealth
+
+	addr        string
+	trans       string // transport.DNS or transport.TLS
+	dial        dialFunc
+	tlsConfig   *tls.Config
+	readTimeout time.Duration
+	expire      time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn // by proto, most recently used last
+}
+
+// maxIdleConns bounds the idle connections per protocol, a burst of queries opens as many connections as it
+// has queries in flight.
+const maxIdleConns = 32
+
+type persistConn struct {
+	*dns.Conn
+	used time.Time
+}
+
+func newDialProxy(addr, trans string, dial dialFunc) *dialProxy {
+	return &dialProxy{
+		upstreamHealth: newUpstreamHealth(),
+		addr:           addr,
+		trans:          trans,
+		dial:           dial,
+		tlsConfig:      new(tls.Config),
+		readTimeout:    defaultReadTimeout,
+		expire:         defaultExpire,
+		idle:           make(map[string][]*persistConn),
+	}
+}
+
+func (p *dialProxy) Addr() string { return p.addr }
+
+func (p *dialProxy) SetTLSConfig(cfg *tls.Config) { p.tlsConfig = cfg }
+
+// SetExpire sets how long idle connections are kept.
+func (p *dialProxy) SetExpire(expire time.Duration) { p.expire = expire }
+
+func (p *dialProxy) SetReadTimeout(d time.Duration) { p.readTimeout = d }
+
+func (p *dialProxy) Start(hcInterval time.Duration) { p.probe.Start(hcInterval) }
+
+func (p *dialProxy) Stop() {
+	p.probe.Stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for proto, conns := range p.idle {
+		for _, pc := range conns {
+			pc.Close()
+		}
+		delete(p.idle, proto)
+	}
+}
+
+func (p *dialProxy) Healthcheck() {
+	proto := "udp"
+	if p.tcp {
+		proto = "tcp"
+	}
+	p.healthcheck(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		return p.exchange(ctx, m, proto)
+	})
+}
+
+// Connect picks the protocol as proxy.Proxy does: DoT upstreams always use TLS, otherwise the protocol of
+// the request unless force_tcp or prefer_udp say otherwise.
+func (p *dialProxy) Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	proto := state.Proto()
+	switch {
+	case opts.ForceTCP: // TCP flag has precedence over UDP flag
+		proto = "tcp"
+	case opts.PreferUDP:
+		proto = "udp"
+	}
+	return p.exchange(ctx, state.Req, proto)
+}
+
+func (p *dialProxy) exchange(ctx context.Context, m *dns.Msg, proto string) (*dns.Msg, error) {
+	if p.trans == transport.TLS {
+		proto = "tcp-tls"
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.readTimeout)
+	defer cancel()
+
+	for retry := true; ; retry = false {
+		pc, cached, err := p.conn(ctx, proto)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := p.roundTrip(ctx, pc, m)
+		if err == nil {
+			p.yield(proto, pc)
+			return ret, nil
+		}
+		pc.Close()
+		// the upstream may have closed the idle connection, retry once on a fresh one
+		if retry && cached && ctx.Err() == nil {
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (p *dialProxy) roundTrip(ctx context.Context, pc *persistConn, m *dns.Msg) (*dns.Msg, error) {
+	deadline, _ := ctx.Deadline()
+	pc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { pc.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := pc.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	for {
+		ret, err := pc.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		// skip late replies to queries that timed out on this connection
+		if ret.Id == m.Id {
+			return ret, nil
+		}
+	}
+}
+
+// conn returns an idle connection for proto or dials a new one, cached reports which.
+func (p *dialProxy) conn(ctx context.Context, proto string) (*persistConn, bool, error) {
+	p.mu.Lock()
+	for conns := p.idle[proto]; len(conns) > 0; conns = p.idle[proto] {
+		pc := conns[len(conns)-1]
+		p.idle[proto] = conns[:len(conns)-1]
+		if time.Since(pc.used) < p.expire {
+			p.mu.Unlock()
+			return pc, true, nil
+		}
+		pc.Close()
+	}
+	p.mu.Unlock()
+
+	network := proto
+	if proto == "tcp-tls" {
+		network = "tcp"
+	}
+	conn, err := p.dial(ctx, network, p.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if proto == "tcp-tls" {
+		tc := tls.Client(conn, p.tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+		conn = tc
+	}
+	return &persistConn{Conn: &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}}, false, nil
+}
+
+// yield puts pc back for reuse, closing the idle connections that expired or are too many, oldest first.
+func (p *dialProxy) yield(proto string, pc *persistConn) {
+	pc.used = time.Now()
+	pc.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[proto]
+	i := 0
+	for ; i < len(conns) && (len(conns)-i >= maxIdleConns || time.Since(conns[i].used) >= p.expire); i++ {
+		conns[i].Close()
+	}
+	n := copy(conns, conns[i:])
+	clear(conns[n:])
+	p.idle[proto] = append(conns[:n], pc)
+}
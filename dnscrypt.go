@@ -0,0 +1,466 @@
+package pforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt v2, see https://dnscrypt.info/protocol.
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+	dnscryptCertSize      = 124
+
+	dnscryptXSalsa20  = 0x0001 // X25519-XSalsa20Poly1305
+	dnscryptXChaCha20 = 0x0002 // X25519-XChacha20Poly1305
+
+	dnscryptMinQueryLen = 256 // padded UDP queries are at least this long
+	dnscryptCertRefresh = time.Hour
+)
+
+var errDNSCryptResponse = errors.New("invalid dnscrypt response")
+
+// dnscryptCert is a resolver certificate, verified with the provider key.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseDNSCryptCert parses bin and verifies its signature with providerPK.
+func parseDNSCryptCert(bin []byte, providerPK ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(bin) < dnscryptCertSize || string(bin[:4]) != dnscryptCertMagic {
+		return nil, errors.New("invalid dnscrypt certificate")
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(bin[4:6])}
+	if cert.esVersion != dnscryptXSalsa20 && cert.esVersion != dnscryptXChaCha20 {
+		return nil, fmt.Errorf("unsupported dnscrypt certificate version %d", cert.esVersion)
+	}
+	// the signature covers everything after it, extensions included
+	if !ed25519.Verify(providerPK, bin[72:], bin[8:72]) {
+		return nil, errors.New("invalid dnscrypt certificate signature")
+	}
+	copy(cert.resolverPK[:], bin[72:104])
+	copy(cert.clientMagic[:], bin[104:112])
+	cert.serial = binary.BigEndian.Uint32(bin[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(bin[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(bin[120:124])), 0)
+	return cert, nil
+}
+
+func (c *dnscryptCert) valid(now time.Time) bool {
+	return !now.Before(c.notBefore) && now.Before(c.notAfter)
+}
+
+// dnscryptSharedKey computes the key shared by sk and the peer public key pk.
+func dnscryptSharedKey(esVersion uint16, sk, pk *[32]byte) ([32]byte, error) {
+	var key [32]byte
+	if esVersion == dnscryptXSalsa20 {
+		box.Precompute(&key, pk, sk)
+		return key, nil
+	}
+
+	shared, err := curve25519.X25519(sk[:], pk[:])
+	if err != nil {
+		return key, err
+	}
+	subkey, err := chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], subkey)
+	return key, nil
+}
+
+// dnscryptSeal encrypts and authenticates msg, the result is the tag followed by the ciphertext.
+func dnscryptSeal(esVersion uint16, key *[32]byte, nonce *[24]byte, msg []byte) []byte {
+	if esVersion == dnscryptXSalsa20 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+
+	// secretbox with XChaCha20 in place of XSalsa20: the first 32 bytes of the key stream are the
+	// Poly1305 key, the message is encrypted with the rest
+	polyKey, c := xchachaStream(key, nonce)
+	out := make([]byte, poly1305.TagSize+len(msg))
+	c.XORKeyStream(out[poly1305.TagSize:], msg)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, out[poly1305.TagSize:], &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// dnscryptOpen authenticates and decrypts a box made by dnscryptSeal.
+func dnscryptOpen(esVersion uint16, key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, bool) {
+	if esVersion == dnscryptXSalsa20 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	polyKey, c := xchachaStream(key, nonce)
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	if !poly1305.Verify(&tag, sealed[poly1305.TagSize:], &polyKey) {
+		return nil, false
+	}
+	msg := make([]byte, len(sealed)-poly1305.TagSize)
+	c.XORKeyStream(msg, sealed[poly1305.TagSize:])
+	return msg, true
+}
+
+// xchachaStream returns the Poly1305 key and the XChaCha20 stream positioned after it.
+func xchachaStream(key *[32]byte, nonce *[24]byte) ([32]byte, *chacha20.Cipher) {
+	var polyKey [32]byte
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:]) // sizes are fixed, can't fail
+	c.XORKeyStream(polyKey[:], polyKey[:])
+	return polyKey, c
+}
+
+// dnscryptPad pads msg ISO/IEC 7816-4 style to a multiple of 64 bytes, at least minLen.
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := (len(msg) + 1 + 63) / 64 * 64
+	if n < minLen {
+		n = minLen
+	}
+	padded := make([]byte, n)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(msg []byte) ([]byte, error) {
+	i := len(msg) - 1
+	for i >= 0 && msg[i] == 0 {
+		i--
+	}
+	if i < 0 || msg[i] != 0x80 {
+		return nil, errDNSCryptResponse
+	}
+	return msg[:i], nil
+}
+
+// dnscryptSession is the client key pair we use with a resolver certificate.
+type dnscryptSession struct {
+	cert      *dnscryptCert
+	publicKey [32]byte
+	sharedKey [32]byte
+	fetched   time.Time
+}
+
+func newDNSCryptSession(cert *dnscryptCert, fetched time.Time) (*dnscryptSession, error) {
+	var sk [32]byte
+	if _, err := rand.Read(sk[:]); err != nil {
+		return nil, err
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	s := &dnscryptSession{cert: cert, fetched: fetched}
+	copy(s.publicKey[:], pk)
+	if s.sharedKey, err = dnscryptSharedKey(cert.esVersion, &sk, &cert.resolverPK); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dnscryptProxy is an upstream speaking DNSCrypt v2. The resolver certificate is fetched on first use and
+// again every dnscryptCertRefresh or when it expires, every certificate gets a fresh client key pair.
+type dnscryptProxy struct {
+	upstreamHealth
+
+	addr         string
+	providerName string
+	providerPK   ed25519.PublicKey
+	readTimeout  time.Duration
+	dial         dialFunc
+
+	mu      sync.Mutex
+	session *dnscryptSession
+}
+
+func newDNSCryptProxy(addr, providerName string, providerPK []byte) *dnscryptProxy {
+	return &dnscryptProxy{
+		upstreamHealth: newUpstreamHealth(),
+		addr:           addr,
+		providerName:   dns.Fqdn(providerName),
+		providerPK:     ed25519.PublicKey(providerPK),
+		readTimeout:    defaultReadTimeout,
+		dial:           new(net.Dialer).DialContext,
+	}
+}
+
+func (p *dnscryptProxy) Addr() string { return p.addr }
+
+func (p *dnscryptProxy) SetReadTimeout(d time.Duration) { p.readTimeout = d }
+
+func (p *dnscryptProxy) Start(hcInterval time.Duration) { p.probe.Start(hcInterval) }
+
+func (p *dnscryptProxy) Stop() { p.probe.Stop() }
+
+func (p *dnscryptProxy) Healthcheck() {
+	proto := "udp"
+	if p.tcp {
+		proto = "tcp"
+	}
+	p.healthcheck(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		return p.exchange(ctx, m, proto)
+	})
+}
+
+// Connect sends the encrypted request, over TCP when the request came in over TCP or force_tcp is set.
+func (p *dnscryptProxy) Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	proto := state.Proto()
+	switch {
+	case opts.ForceTCP: // TCP flag has precedence over UDP flag
+		proto = "tcp"
+	case opts.PreferUDP:
+		proto = "udp"
+	}
+	return p.exchange(ctx, state.Req, proto)
+}
+
+func (p *dnscryptProxy) exchange(ctx context.Context, m *dns.Msg, proto string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.readTimeout)
+	defer cancel()
+
+	s, err := p.currentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := p.roundTrip(ctx, s, query, proto)
+	if err == nil && ret.Truncated && proto == "udp" {
+		ret, err = p.roundTrip(ctx, s, query, "tcp")
+	}
+	if errors.Is(err, errDNSCryptResponse) {
+		// maybe the resolver rotated its keys, fetch the certificate again
+		p.forget(s)
+	}
+	return ret, err
+}
+
+// roundTrip sends the encrypted query and decrypts the response.
+func (p *dnscryptProxy) roundTrip(ctx context.Context, s *dnscryptSession, query []byte, proto string) (*dns.Msg, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+	minLen := 0
+	if proto == "udp" {
+		minLen = dnscryptMinQueryLen
+	}
+	packet := make([]byte, 0, 8+32+12+poly1305.TagSize+len(query)+64)
+	packet = append(packet, s.cert.clientMagic[:]...)
+	packet = append(packet, s.publicKey[:]...)
+	packet = append(packet, nonce[:12]...)
+	packet = append(packet, dnscryptSeal(s.cert.esVersion, &s.sharedKey, &nonce, dnscryptPad(query, minLen))...)
+
+	resp, err := p.send(ctx, packet, proto)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 8+24+poly1305.TagSize || string(resp[:8]) != dnscryptResolverMagic || subtle.ConstantTimeCompare(resp[8:20], nonce[:12]) != 1 {
+		return nil, errDNSCryptResponse
+	}
+	copy(nonce[:], resp[8:32])
+	msg, ok := dnscryptOpen(s.cert.esVersion, &s.sharedKey, &nonce, resp[32:])
+	if !ok {
+		return nil, errDNSCryptResponse
+	}
+	if msg, err = dnscryptUnpad(msg); err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(msg); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// send writes packet to the resolver and returns what it sends back, TCP messages are length prefixed.
+func (p *dnscryptProxy) send(ctx context.Context, packet []byte, proto string) ([]byte, error) {
+	conn, err := p.dial(ctx, proto, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if proto == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(packet)))
+	if _, err := conn.Write(append(length[:], packet...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// currentSession returns the session of the current certificate, fetching it when needed.
+func (p *dnscryptProxy) currentSession(ctx context.Context) (*dnscryptSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if s := p.session; s != nil && s.cert.valid(now) && now.Sub(s.fetched) < dnscryptCertRefresh {
+		return s, nil
+	}
+	cert, err := p.fetchCert(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newDNSCryptSession(cert, now)
+	if err != nil {
+		return nil, err
+	}
+	p.session = s
+	return s, nil
+}
+
+// forget drops s if it is still the current session.
+func (p *dnscryptProxy) forget(s *dnscryptSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.session == s {
+		p.session = nil
+	}
+}
+
+// fetchCert asks the resolver for its certificates and returns the valid one with the highest serial,
+// preferring XChaCha20 on a tie.
+func (p *dnscryptProxy) fetchCert(ctx context.Context, now time.Time) (*dnscryptCert, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(p.providerName, dns.TypeTXT)
+	m.SetEdns0(dns.DefaultMsgSize, false) // a few certificates don't fit in 512 bytes
+	proto := "udp"
+	if p.tcp {
+		proto = "tcp"
+	}
+	ret, err := p.plainExchange(ctx, m, proto)
+	if err == nil && ret.Truncated && proto == "udp" {
+		ret, err = p.plainExchange(ctx, m, "tcp")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	for _, rr := range ret.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		bin, err := txtBytes(txt)
+		if err != nil {
+			continue
+		}
+		cert, err := parseDNSCryptCert(bin, p.providerPK)
+		if err != nil {
+			log.Warningf("Ignoring dnscrypt certificate of %s: %v", p.addr, err)
+			continue
+		}
+		if !cert.valid(now) {
+			continue
+		}
+		if best == nil || cert.serial > best.serial || cert.serial == best.serial && cert.esVersion > best.esVersion {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate for %s from %s", p.providerName, p.addr)
+	}
+	return best, nil
+}
+
+// plainExchange sends the unencrypted m, only certificate requests are.
+func (p *dnscryptProxy) plainExchange(ctx context.Context, m *dns.Msg, proto string) (*dns.Msg, error) {
+	conn, err := p.dial(ctx, proto, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	co := &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	return co.ReadMsg()
+}
+
+// txtBytes returns the concatenated character strings of txt as sent on the wire, miekg/dns keeps them
+// escaped in Txt.
+func txtBytes(txt *dns.TXT) ([]byte, error) {
+	buf := make([]byte, dns.Len(txt))
+	off, err := dns.PackRR(txt, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rdata := buf[off-int(txt.Hdr.Rdlength) : off]
+
+	var bin bytes.Buffer
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if 1+n > len(rdata) {
+			return nil, errors.New("invalid TXT record")
+		}
+		bin.Write(rdata[1 : 1+n])
+		rdata = rdata[1+n:]
+	}
+	return bin.Bytes(), nil
+}
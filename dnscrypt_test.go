@@ -0,0 +1,277 @@
+package pforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+const testProviderName = "2.dnscrypt-cert.example.org."
+
+type dnscryptServerCert struct {
+	*dnscryptCert
+	bin []byte
+	sk  [32]byte
+}
+
+// dnscryptServer is a DNSCrypt resolver on loopback UDP answering A queries with 127.0.0.1.
+type dnscryptServer struct {
+	addr       string
+	providerPK ed25519.PublicKey
+	providerSK ed25519.PrivateKey
+
+	mu    sync.Mutex
+	certs []*dnscryptServerCert
+}
+
+func newDNSCryptServer(t *testing.T) *dnscryptServer {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	s := &dnscryptServer{addr: pc.LocalAddr().String(), providerPK: pk, providerSK: sk}
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.handle(buf[:n]); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	return s
+}
+
+// setCerts replaces the served certificates with new ones, valid from notBefore for a day.
+func (s *dnscryptServer) setCerts(t *testing.T, notBefore time.Time, versions []uint16, serials []uint32) {
+	var certs []*dnscryptServerCert
+	for i, version := range versions {
+		c := &dnscryptServerCert{dnscryptCert: &dnscryptCert{esVersion: version, serial: serials[i]}}
+		if _, err := rand.Read(c.sk[:]); err != nil {
+			t.Fatal(err)
+		}
+		pk, _ := curve25519.X25519(c.sk[:], curve25519.Basepoint)
+		copy(c.resolverPK[:], pk)
+		binary.BigEndian.PutUint32(c.clientMagic[:], serials[i])
+
+		signed := append([]byte{}, c.resolverPK[:]...)
+		signed = append(signed, c.clientMagic[:]...)
+		signed = binary.BigEndian.AppendUint32(signed, serials[i])
+		signed = binary.BigEndian.AppendUint32(signed, uint32(notBefore.Unix()))
+		signed = binary.BigEndian.AppendUint32(signed, uint32(notBefore.Add(24*time.Hour).Unix()))
+		c.bin = append([]byte(dnscryptCertMagic), byte(version>>8), byte(version), 0, 0)
+		c.bin = append(c.bin, ed25519.Sign(s.providerSK, signed)...)
+		c.bin = append(c.bin, signed...)
+		certs = append(certs, c)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+}
+
+func (s *dnscryptServer) handle(pkt []byte) []byte {
+	s.mu.Lock()
+	certs := s.certs
+	s.mu.Unlock()
+
+	for _, c := range certs {
+		if len(pkt) > 8+32+12 && bytes.Equal(pkt[:8], c.clientMagic[:]) {
+			return s.handleQuery(c, pkt)
+		}
+	}
+
+	// not encrypted, a certificate request
+	m := new(dns.Msg)
+	if err := m.Unpack(pkt); err != nil || m.Question[0].Name != testProviderName || m.Question[0].Qtype != dns.TypeTXT {
+		return nil
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	for _, c := range certs {
+		ret.Answer = append(ret.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: testProviderName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{escapeTXT(c.bin)},
+		})
+	}
+	out, _ := ret.Pack()
+	return out
+}
+
+func (s *dnscryptServer) handleQuery(c *dnscryptServerCert, pkt []byte) []byte {
+	var clientPK [32]byte
+	var nonce [24]byte
+	copy(clientPK[:], pkt[8:40])
+	copy(nonce[:], pkt[40:52])
+	key, err := dnscryptSharedKey(c.esVersion, &c.sk, &clientPK)
+	if err != nil {
+		return nil
+	}
+	msg, ok := dnscryptOpen(c.esVersion, &key, &nonce, pkt[52:])
+	if !ok || len(msg) < dnscryptMinQueryLen {
+		return nil
+	}
+	if msg, err = dnscryptUnpad(msg); err != nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(msg); err != nil {
+		return nil
+	}
+
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" IN A 127.0.0.1"))
+	}
+	out, _ := ret.Pack()
+	rand.Read(nonce[12:])
+	resp := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	return append(resp, dnscryptSeal(c.esVersion, &key, &nonce, dnscryptPad(out, 0))...)
+}
+
+// escapeTXT returns bin in the presentation format miekg/dns expects in Txt.
+func escapeTXT(bin []byte) string {
+	var sb strings.Builder
+	for _, b := range bin {
+		if b < ' ' || b > '~' || b == '"' || b == '\\' {
+			fmt.Fprintf(&sb, "\\%03d", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+func TestDNSCrypt(t *testing.T) {
+	defaultTimeout = 5 * time.Second
+
+	for _, version := range []uint16{dnscryptXSalsa20, dnscryptXChaCha20} {
+		s := newDNSCryptServer(t)
+		s.setCerts(t, time.Now().Add(-time.Hour), []uint16{version}, []uint32{1})
+
+		st := encodeStamp(&stamp{proto: stampDNSCrypt, addr: s.addr, providerPK: s.providerPK, providerName: testProviderName})
+		c := caddy.NewTestController("dns", "pforward . "+st)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Failed to create forwarder: %s", err)
+		}
+		f := fs[0]
+		if _, ok := f.proxies[0].(*dnscryptProxy); !ok {
+			t.Fatalf("expected a dnscrypt upstream, got %T", f.proxies[0])
+		}
+		f.OnStartup()
+		defer f.OnShutdown()
+
+		for i := 0; i < 3; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+				t.Fatalf("version=%d expected to receive reply, but didn't: %v", version, err)
+			}
+			if rec.Msg.Id != m.Id || len(rec.Msg.Answer) != 1 {
+				t.Fatalf("version=%d unexpected reply %v", version, rec.Msg)
+			}
+		}
+	}
+}
+
+func TestDNSCryptCertRotation(t *testing.T) {
+	s := newDNSCryptServer(t)
+	now := time.Now()
+	// serial 3 is not valid yet
+	s.setCerts(t, now.Add(-time.Hour), []uint16{dnscryptXSalsa20, dnscryptXChaCha20, dnscryptXSalsa20}, []uint32{1, 2, 2})
+	future := newDNSCryptServer(t)
+	future.providerPK, future.providerSK = s.providerPK, s.providerSK
+	future.setCerts(t, now.Add(time.Hour), []uint16{dnscryptXChaCha20}, []uint32{3})
+	s.mu.Lock()
+	s.certs = append(s.certs, future.certs...)
+	s.mu.Unlock()
+
+	p := newDNSCryptProxy(s.addr, testProviderName, s.providerPK)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := p.exchange(context.TODO(), m, "udp"); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if cert := p.session.cert; cert.serial != 2 || cert.esVersion != dnscryptXChaCha20 {
+		t.Errorf("expected the XChaCha20 certificate with serial 2, got serial %d version %d", cert.serial, cert.esVersion)
+	}
+
+	// the resolver rotated its certificate, it is picked up on refresh
+	s.setCerts(t, now.Add(-time.Hour), []uint16{dnscryptXSalsa20}, []uint32{4})
+	p.session.fetched = now.Add(-dnscryptCertRefresh)
+	if _, err := p.exchange(context.TODO(), m, "udp"); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if cert := p.session.cert; cert.serial != 4 {
+		t.Errorf("expected the rotated certificate, got serial %d", cert.serial)
+	}
+
+	// certificates signed by someone else are ignored
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	s.providerSK = other
+	s.setCerts(t, now.Add(-time.Hour), []uint16{dnscryptXSalsa20}, []uint32{5})
+	p.session = nil
+	if _, err := p.exchange(context.TODO(), m, "udp"); err == nil {
+		t.Error("expected error with a forged certificate")
+	}
+}
+
+func TestDNSCryptBox(t *testing.T) {
+	var key [32]byte
+	var nonce [24]byte
+	rand.Read(key[:])
+	rand.Read(nonce[:])
+	msg := []byte("the quick brown fox jumps over the lazy dog, a message longer than one block of 64 bytes")
+
+	for _, version := range []uint16{dnscryptXSalsa20, dnscryptXChaCha20} {
+		sealed := dnscryptSeal(version, &key, &nonce, msg)
+		if len(sealed) != len(msg)+16 {
+			t.Fatalf("version=%d expected %d bytes, got %d", version, len(msg)+16, len(sealed))
+		}
+		if opened, ok := dnscryptOpen(version, &key, &nonce, sealed); !ok || !bytes.Equal(opened, msg) {
+			t.Errorf("version=%d expected to open the box", version)
+		}
+		sealed[20] ^= 1
+		if _, ok := dnscryptOpen(version, &key, &nonce, sealed); ok {
+			t.Errorf("version=%d expected a tampered box to be rejected", version)
+		}
+	}
+
+	padded := dnscryptPad(msg, dnscryptMinQueryLen)
+	if len(padded) != dnscryptMinQueryLen {
+		t.Errorf("expected %d padded bytes, got %d", dnscryptMinQueryLen, len(padded))
+	}
+	if len(dnscryptPad(make([]byte, 64), 0)) != 128 {
+		t.Error("expected padding to the next multiple of 64")
+	}
+	if unpadded, err := dnscryptUnpad(padded); err != nil || !bytes.Equal(unpadded, msg) {
+		t.Errorf("expected to unpad, got %v", err)
+	}
+}
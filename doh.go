@@ -0,0 +1,150 @@
+package pforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDoHPath = "/dns-query"
+	dohMediaType   = "application/dns-message"
+)
+
+// dohProxy is an upstream speaking DNS over HTTPS (RFC 8484). Queries share the HTTP/2 connections of
+// the transport, idle ones are closed after expire.
+type dohProxy struct {
+	upstreamHealth
+
+	addr        string // host:port
+	url         string
+	method      string // http.MethodGet or http.MethodPost
+	readTimeout time.Duration
+	dial        dialFunc
+
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newDoHProxy(addr, path string) *dohProxy {
+	p := &dohProxy{
+		upstreamHealth: newUpstreamHealth(),
+		addr:           addr,
+		url:            "https://" + addr + path,
+		method:         http.MethodPost,
+		readTimeout:    defaultReadTimeout,
+		dial:           (&net.Dialer{Timeout: defaultReadTimeout}).DialContext,
+	}
+	p.transport = &http.Transport{
+		// the URL may name the host, we always connect to addr
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return p.dial(ctx, network, addr)
+		},
+		TLSClientConfig:     new(tls.Config),
+		TLSHandshakeTimeout: defaultReadTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     defaultExpire,
+	}
+	p.client = &http.Client{Transport: p.transport}
+	return p
+}
+
+func (p *dohProxy) Addr() string { return p.addr }
+
+// SetTLSConfig sets the TLS config of the transport, cfg is cloned as HTTP/2 adds its ALPN protocol to it.
+func (p *dohProxy) SetTLSConfig(cfg *tls.Config) { p.transport.TLSClientConfig = cfg.Clone() }
+
+// SetExpire sets how long idle connections are kept.
+func (p *dohProxy) SetExpire(expire time.Duration) { p.transport.IdleConnTimeout = expire }
+
+func (p *dohProxy) SetReadTimeout(d time.Duration) { p.readTimeout = d }
+
+func (p *dohProxy) Start(hcInterval time.Duration) { p.probe.Start(hcInterval) }
+
+func (p *dohProxy) Stop() {
+	p.probe.Stop()
+	p.transport.CloseIdleConnections()
+}
+
+func (p *dohProxy) Healthcheck() { p.healthcheck(p.exchange) }
+
+// Connect sends the request over HTTPS, opts are meaningless here.
+func (p *dohProxy) Connect(ctx context.Context, state request.Request, _ proxy.Options) (*dns.Msg, error) {
+	return p.exchange(ctx, state.Req)
+}
+
+func (p *dohProxy) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.readTimeout)
+	defer cancel()
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 section 4.1: the ID should be 0 for HTTP caches
+	buf[0], buf[1] = 0, 0
+
+	var req *http.Request
+	if p.method == http.MethodGet {
+		sep := "?"
+		if strings.Contains(p.url, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q from %s", resp.Status, p.url)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	ret.Id = m.Id
+	return ret, nil
+}
+
+// cutPath splits the path off an https:// address, addresses of other transports have no path.
+func cutPath(addr string) (string, string) {
+	const prefix = "https://"
+	if !strings.HasPrefix(addr, prefix) {
+		return addr, ""
+	}
+	i := strings.IndexByte(addr[len(prefix):], '/')
+	if i < 0 {
+		return addr, defaultDoHPath
+	}
+	return addr[:len(prefix)+i], addr[len(prefix)+i:]
+}
@@ -0,0 +1,158 @@
+package pforward
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newDoHServer starts an HTTP/2 DoH server answering A queries with 127.0.0.1, it counts the connections
+// in conns and checks the method and path of every request.
+func newDoHServer(t *testing.T, method, path string, conns *int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method || r.URL.Path != path || r.ProtoMajor != 2 {
+			t.Errorf("unexpected %s %s %s", r.Proto, r.Method, r.URL.Path)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var buf []byte
+		var err error
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, err = io.ReadAll(r.Body)
+		}
+		m := new(dns.Msg)
+		if err == nil {
+			err = m.Unpack(buf)
+		}
+		if err != nil || m.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" IN A 127.0.0.1"))
+		}
+		out, _ := ret.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDoH(t *testing.T) {
+	defaultTimeout = 5 * time.Second
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		var conns int32
+		s := newDoHServer(t, method, "/resolve", &conns)
+
+		c := caddy.NewTestController("dns", "pforward . "+s.URL+"/resolve {\ndoh_method "+method+"\n}")
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Failed to create forwarder: %s", err)
+		}
+		f := fs[0]
+		p := f.proxies[0].(*dohProxy)
+		p.SetTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+		f.OnStartup()
+		defer f.OnShutdown()
+
+		for i := 0; i < 5; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+				t.Fatalf("method=%s expected to receive reply, but didn't: %v", method, err)
+			}
+			if rec.Msg.Id != m.Id || len(rec.Msg.Answer) != 1 {
+				t.Fatalf("method=%s unexpected reply %v", method, rec.Msg)
+			}
+		}
+		if n := atomic.LoadInt32(&conns); n != 1 {
+			t.Errorf("method=%s expected queries to share one connection, got %d", method, n)
+		}
+	}
+}
+
+func TestDoHHealthcheck(t *testing.T) {
+	var conns int32
+	s := newDoHServer(t, http.MethodPost, defaultDoHPath, &conns)
+
+	// configured before the probe runs, it reads the timeout
+	p := newDoHProxy(s.Listener.Addr().String(), defaultDoHPath)
+	p.SetTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+	p.SetReadTimeout(500 * time.Millisecond)
+	p.Start(10 * time.Millisecond)
+	defer p.Stop()
+
+	p.Healthcheck()
+	time.Sleep(50 * time.Millisecond)
+	if p.Down(1) || atomic.LoadUint32(&p.fails) != 0 {
+		t.Fatalf("expected healthy upstream, got %d fails", atomic.LoadUint32(&p.fails))
+	}
+
+	s.Close()
+	p.Healthcheck()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Down(1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected upstream to be down, got %d fails", atomic.LoadUint32(&p.fails))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoHParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		addr     string
+		url      string
+		method   string
+		hasError bool
+	}{
+		{"pforward . https://1.1.1.1", "1.1.1.1:443", "https://1.1.1.1:443/dns-query", http.MethodPost, false},
+		{"pforward . https://1.1.1.1:8443/resolve?ct", "1.1.1.1:8443", "https://1.1.1.1:8443/resolve?ct", http.MethodPost, false},
+		{"pforward . https://[2606:4700::1111]:443/dns-query {\ndoh_method get\n}", "[2606:4700::1111]:443", "https://[2606:4700::1111]:443/dns-query", http.MethodGet, false},
+		{"pforward . https://1.1.1.1 {\ndoh_method PUT\n}", "", "", "", true},
+		{"pforward . https://1.1.1.1 {\ndoh_method\n}", "", "", "", true},
+	}
+	for _, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		fs, err := parseForward(c)
+		if (err != nil) != tc.hasError {
+			t.Fatalf("input=%q expected error=%v, got %v", tc.input, tc.hasError, err)
+		}
+		if tc.hasError {
+			continue
+		}
+		p := fs[0].proxies[0].(*dohProxy)
+		if p.Addr() != tc.addr || p.url != tc.url || p.method != tc.method {
+			t.Errorf("input=%q expected %s %s %s, got %s %s %s", tc.input, tc.addr, tc.url, tc.method, p.Addr(), p.url, p.method)
+		}
+	}
+}
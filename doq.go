@@ -0,0 +1,209 @@
+package pforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ error codes, RFC 9250 section 4.3.
+const (
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+// doqProxy is an upstream speaking DNS over QUIC (RFC 9250). All queries share one connection, each on
+// its own stream. Connections are dialed with 0-RTT, which TLS only uses when it has a session ticket
+// from the upstream.
+type doqProxy struct {
+	upstreamHealth
+
+	addr        string
+	readTimeout time.Duration
+	tlsConfig   *tls.Config
+	quicConfig  *quic.Config
+	// listenPacket returns the socket of the transport, nil for a local UDP socket
+	listenPacket func(ctx context.Context) (net.PacketConn, error)
+
+	mu        sync.Mutex
+	transport *quic.Transport // bound to one UDP socket for all connections
+	conn      quic.EarlyConnection
+}
+
+func newDoQProxy(addr string) *doqProxy {
+	return &doqProxy{
+		upstreamHealth: newUpstreamHealth(),
+		addr:           addr,
+		readTimeout:    defaultReadTimeout,
+		tlsConfig:      &tls.Config{NextProtos: []string{"doq"}},
+		quicConfig:     &quic.Config{HandshakeIdleTimeout: defaultReadTimeout, MaxIdleTimeout: defaultExpire},
+	}
+}
+
+func (p *doqProxy) Addr() string { return p.addr }
+
+// SetTLSConfig sets the TLS config of new connections, cfg is cloned to set the DoQ ALPN protocol.
+func (p *doqProxy) SetTLSConfig(cfg *tls.Config) {
+	p.tlsConfig = cfg.Clone()
+	p.tlsConfig.NextProtos = []string{"doq"}
+}
+
+// SetExpire sets how long an idle connection is kept.
+func (p *doqProxy) SetExpire(expire time.Duration) { p.quicConfig.MaxIdleTimeout = expire }
+
+func (p *doqProxy) SetReadTimeout(d time.Duration) { p.readTimeout = d }
+
+func (p *doqProxy) Start(hcInterval time.Duration) { p.probe.Start(hcInterval) }
+
+func (p *doqProxy) Stop() {
+	p.probe.Stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.CloseWithError(doqNoError, "")
+		p.conn = nil
+	}
+	if p.transport != nil {
+		p.transport.Close()
+		p.transport.Conn.Close() // not closed by the transport as we created it
+		p.transport = nil
+	}
+}
+
+func (p *doqProxy) Healthcheck() { p.healthcheck(p.exchange) }
+
+// Connect sends the request over QUIC, opts are meaningless here.
+func (p *doqProxy) Connect(ctx context.Context, state request.Request, _ proxy.Options) (*dns.Msg, error) {
+	return p.exchange(ctx, state.Req)
+}
+
+func (p *doqProxy) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.readTimeout)
+	defer cancel()
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 9250 section 4.2.1: the ID must be 0, the stream identifies the query
+	buf[0], buf[1] = 0, 0
+
+	for retry := true; ; retry = false {
+		conn, cached, err := p.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := p.roundTrip(ctx, conn, buf)
+		if err == nil {
+			ret.Id = m.Id
+			return ret, nil
+		}
+		// the cached connection went away or the 0-RTT data was rejected, retry once on a fresh connection
+		if retry && ctx.Err() == nil && (cached && conn.Context().Err() != nil || errors.Is(err, quic.Err0RTTRejected)) {
+			p.forget(conn)
+			continue
+		}
+		return nil, err
+	}
+}
+
+// roundTrip sends the query buf on a new stream of conn and reads the reply.
+func (p *doqProxy) roundTrip(ctx context.Context, conn quic.EarlyConnection, buf []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+	if _, err := stream.Write(msg); err != nil {
+		return nil, err
+	}
+	// a single query per stream, close our side
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, msg); err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(msg); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// connection returns the shared connection, dialing a new one when there is none or it was closed.
+// cached reports whether the connection was used before.
+func (p *doqProxy) connection(ctx context.Context) (quic.EarlyConnection, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && p.conn.Context().Err() == nil {
+		return p.conn, true, nil
+	}
+
+	if p.transport == nil {
+		var pc net.PacketConn
+		var err error
+		if p.listenPacket != nil {
+			pc, err = p.listenPacket(ctx)
+		} else {
+			pc, err = net.ListenUDP("udp", nil)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		p.transport = &quic.Transport{Conn: pc}
+	}
+	addr, err := net.ResolveUDPAddr("udp", p.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err := p.transport.DialEarly(ctx, addr, p.tlsConfig, p.quicConfig)
+	if err != nil {
+		if p.listenPacket != nil {
+			// the relay may be gone, start over with a new one
+			p.transport.Close()
+			p.transport.Conn.Close()
+			p.transport = nil
+		}
+		return nil, false, err
+	}
+	p.conn = conn
+	return conn, false, nil
+}
+
+// forget drops conn if it is still the shared connection.
+func (p *doqProxy) forget(conn quic.EarlyConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == conn {
+		conn.CloseWithError(doqNoError, "")
+		p.conn = nil
+	}
+}
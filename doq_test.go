@@ -0,0 +1,221 @@
+package pforward
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// newTestCert returns a self-signed certificate for 127.0.0.1 and a pool trusting it.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pforward test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+type doqServer struct {
+	*quic.EarlyListener
+	conns    int32
+	used0RTT int32
+}
+
+// newDoQServer starts a DoQ server answering A queries with 127.0.0.1 and accepting 0-RTT.
+func newDoQServer(t *testing.T, cert tls.Certificate) *doqServer {
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &doqServer{EarlyListener: l}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			if conn.ConnectionState().Used0RTT {
+				atomic.AddInt32(&s.used0RTT, 1)
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveDoQStream(stream)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func serveDoQStream(stream quic.Stream) {
+	defer stream.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil || m.Id != 0 {
+		stream.CancelWrite(0x1) // DOQ_INTERNAL_ERROR
+		return
+	}
+
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" IN A 127.0.0.1"))
+	}
+	out, _ := ret.Pack()
+	binary.BigEndian.PutUint16(length[:], uint16(len(out)))
+	stream.Write(append(length[:], out...))
+}
+
+func TestDoQ(t *testing.T) {
+	defaultTimeout = 5 * time.Second
+
+	cert, pool := newTestCert(t)
+	s := newDoQServer(t, cert)
+
+	c := caddy.NewTestController("dns", "pforward . quic://"+s.Addr().String())
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	p := f.proxies[0].(*doqProxy)
+	p.SetTLSConfig(&tls.Config{RootCAs: pool, ClientSessionCache: tls.NewLRUClientSessionCache(1)})
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Expected to receive reply, but didn't: %v", err)
+		}
+		if rec.Msg.Id != m.Id || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("unexpected reply %v", rec.Msg)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		query()
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("expected queries to share one connection, got %d", n)
+	}
+
+	// the resumed connection sends its query as 0-RTT data
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	p.forget(conn)
+	query()
+	if n := atomic.LoadInt32(&s.conns); n != 2 {
+		t.Errorf("expected a new connection, got %d", n)
+	}
+	if n := atomic.LoadInt32(&s.used0RTT); n != 1 {
+		t.Errorf("expected the new connection to use 0-RTT, got %d", n)
+	}
+
+	// a closed connection is replaced transparently
+	p.mu.Lock()
+	p.conn.CloseWithError(doqNoError, "")
+	p.mu.Unlock()
+	query()
+	if n := atomic.LoadInt32(&s.conns); n != 3 {
+		t.Errorf("expected a new connection, got %d", n)
+	}
+}
+
+func TestDoQHealthcheck(t *testing.T) {
+	cert, pool := newTestCert(t)
+	s := newDoQServer(t, cert)
+
+	// configured before the probe runs, it reads the timeout
+	p := newDoQProxy(s.Addr().String())
+	p.SetTLSConfig(&tls.Config{RootCAs: pool})
+	p.SetReadTimeout(500 * time.Millisecond)
+	p.Start(10 * time.Millisecond)
+	defer p.Stop()
+
+	p.Healthcheck()
+	time.Sleep(100 * time.Millisecond)
+	if p.Down(1) || atomic.LoadUint32(&p.fails) != 0 {
+		t.Fatalf("expected healthy upstream, got %d fails", atomic.LoadUint32(&p.fails))
+	}
+
+	s.Close()
+	p.Healthcheck()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Down(1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected upstream to be down, got %d fails", atomic.LoadUint32(&p.fails))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoQParse(t *testing.T) {
+	c := caddy.NewTestController("dns", "pforward . quic://127.0.0.1 quic://127.0.0.2:8853")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	for i, expected := range []string{"127.0.0.1:853", "127.0.0.2:8853"} {
+		p, ok := fs[0].proxies[i].(*doqProxy)
+		if !ok || p.Addr() != expected {
+			t.Errorf("expected DoQ upstream %s, got %v", expected, fs[0].proxies[i].Addr())
+		}
+		if len(p.tlsConfig.NextProtos) != 1 || p.tlsConfig.NextProtos[0] != "doq" {
+			t.Errorf("expected doq ALPN, got %v", p.tlsConfig.NextProtos)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package pforward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialFunc dials addr over network, "tcp" or "udp". (*net.Dialer).DialContext is one.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+var errEgressUDP = errors.New("egress proxy can't carry UDP")
+
+// egress is the proxy all connections of a stanza leave through: SOCKS5 (RFC 1928) with CONNECT and
+// UDP ASSOCIATE, or HTTP with CONNECT only.
+type egress struct {
+	scheme   string // "socks5" or "http"
+	addr     string // host:port of the proxy
+	user     *url.Userinfo
+	redacted string // the URL without password, for logging
+}
+
+// parseEgress parses socks5://[user:password@]host:port or http://[user:password@]host:port.
+func parseEgress(s string) (*egress, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress '%s': %v", s, err)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		u.Scheme = "socks5"
+		if port == "" {
+			port = "1080"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return nil, fmt.Errorf("invalid egress '%s': scheme must be socks5 or http", s)
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid egress '%s': expected %s://host:port", s, u.Scheme)
+	}
+	return &egress{scheme: u.Scheme, addr: net.JoinHostPort(u.Hostname(), port), user: u.User, redacted: u.Redacted()}, nil
+}
+
+func (e *egress) String() string { return e.redacted }
+
+// udp reports whether the proxy can carry UDP.
+func (e *egress) udp() bool { return e.scheme == "socks5" }
+
+// DialContext connects to addr through the proxy. UDP "connections" are relayed with UDP ASSOCIATE.
+func (e *egress) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := e.associate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pc.raddr = raddr
+		return pc, nil
+	default:
+		return nil, fmt.Errorf("egress: unsupported network %s", network)
+	}
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := e.deadline(ctx, conn)
+	defer stop()
+
+	if e.scheme == "http" {
+		err = e.httpConnect(conn, addr)
+	} else {
+		err = e.socksRequest(conn, socksConnect, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("egress %s to %s: %v", e, addr, err)
+	}
+	return conn, nil
+}
+
+// ListenPacket returns a packet conn relaying datagrams through the SOCKS5 proxy. It lives as long as its
+// TCP control connection.
+func (e *egress) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	pc, err := e.associate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// associate sends UDP ASSOCIATE and returns a packet conn to the relay.
+func (e *egress) associate(ctx context.Context) (*socksPacketConn, error) {
+	if !e.udp() {
+		return nil, errEgressUDP
+	}
+	ctrl, err := new(net.Dialer).DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := e.deadline(ctx, ctrl)
+	defer stop()
+
+	// we don't know the address we send from, see RFC 1928 section 6
+	if err := e.socksRequest(ctrl, socksUDPAssociate, "0.0.0.0:0"); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("egress %s: %v", e, err)
+	}
+	relay, err := readSocksAddr(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("egress %s: %v", e, err)
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay is on the proxy host
+		host, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+		relay.IP = net.ParseIP(host)
+	}
+
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc := &socksPacketConn{relay: udp, ctrl: ctrl}
+	// the association ends when the control connection closes
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		udp.Close()
+	}()
+	return pc, nil
+}
+
+// deadline makes the handshake on conn honor ctx, the returned func clears it.
+func (e *egress) deadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(defaultReadTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+func (e *egress) httpConnect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if e.user != nil {
+		password, _ := e.user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(e.user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// a byte at a time, what follows the response belongs to the tunnel
+	// the body is not read, it would be the tunnel
+	resp, err := http.ReadResponse(bufio.NewReader(oneByteReader{conn}), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT: %s", resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader reads at most one byte per call so bufio doesn't read ahead.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
+
+// SOCKS5 commands, methods and address types.
+const (
+	socksVersion      = 0x05
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksNoAuth       = 0x00
+	socksUserPassword = 0x02
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+// socksRequest negotiates the method, authenticates and sends cmd for addr. For UDP ASSOCIATE the bound
+// address of the reply, the relay, is left for the caller to read.
+func (e *egress) socksRequest(conn net.Conn, cmd byte, addr string) error {
+	method := byte(socksNoAuth)
+	if e.user != nil {
+		method = socksUserPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", buf[0])
+	}
+	if buf[1] != method {
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+
+	if method == socksUserPassword {
+		// RFC 1929
+		user := e.user.Username()
+		password, _ := e.user.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS user or password too long")
+		}
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("SOCKS authentication failed")
+		}
+	}
+
+	req, err := appendSocksAddr([]byte{socksVersion, cmd, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS request failed with code %d", reply[1])
+	}
+	if cmd == socksConnect {
+		_, err = readSocksAddr(conn)
+	}
+	return err
+}
+
+// appendSocksAddr appends the SOCKS encoding of host:port addr to b.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		b = append(append(b, socksDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksIPv4), ip4...)
+	} else {
+		b = append(append(b, socksIPv6), ip...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// readSocksAddr reads an address, domain names are resolved.
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socksIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		host = make([]byte, n[0])
+	default:
+		return nil, fmt.Errorf("unknown SOCKS address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	if atyp[0] == socksDomain {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))))
+	}
+	return &net.UDPAddr{IP: net.IP(host), Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// socksPacketConn sends datagrams through a SOCKS5 UDP relay. Read and Write talk to raddr when it is
+// set, as for a connected UDP socket, so dns.Conn treats it like one.
+type socksPacketConn struct {
+	relay *net.UDPConn
+	ctrl  net.Conn
+	raddr *net.UDPAddr
+}
+
+func (c *socksPacketConn) LocalAddr() net.Addr { return c.relay.LocalAddr() }
+
+func (c *socksPacketConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.relay.RemoteAddr()
+}
+
+func (c *socksPacketConn) SetDeadline(t time.Time) error      { return c.relay.SetDeadline(t) }
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error  { return c.relay.SetReadDeadline(t) }
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error { return c.relay.SetWriteDeadline(t) }
+
+func (c *socksPacketConn) Write(b []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, errors.New("socks: no destination address")
+	}
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// RSV, FRAG and the destination precede the data
+	pkt, err := appendSocksAddr([]byte{0x00, 0x00, 0x00}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.relay.Write(append(pkt, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.readFrom(b)
+		if err != nil || c.raddr == nil {
+			return n, err
+		}
+		if from.IP.Equal(c.raddr.IP) && from.Port == c.raddr.Port {
+			return n, nil
+		}
+	}
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.readFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, from, nil
+}
+
+func (c *socksPacketConn) readFrom(b []byte) (int, *net.UDPAddr, error) {
+	buf := make([]byte, 3+1+1+255+2+len(b))
+	for {
+		n, err := c.relay.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// fragments are not supported, drop them as RFC 1928 allows
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		from, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), from, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.relay.Close()
+}
@@ -0,0 +1,164 @@
+package pforward
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"strings"
+)
+
+// rulesetFormat is the syntax of a ruleset file.
+type rulesetFormat int
+
+const (
+	formatAuto    rulesetFormat = iota // detected from the content
+	formatPlain                        // one rule per line and include:, see parseRule
+	formatDnsmasq                      // server=/domain/ip, as in felixonmars/dnsmasq-china-list
+	formatAdGuard                      // ||domain^ and @@||domain^, as in AdGuard and ABP filters
+	formatHosts                        // /etc/hosts
+)
+
+var rulesetFormats = map[string]rulesetFormat{
+	"auto":    formatAuto,
+	"plain":   formatPlain,
+	"dnsmasq": formatDnsmasq,
+	"adguard": formatAdGuard,
+	"hosts":   formatHosts,
+}
+
+// dnsmasqOptions are the dnsmasq options taking /domain/.../ lists.
+var dnsmasqOptions = []string{"server=", "local=", "address=", "ipset=", "nftset="}
+
+// detectFormat guesses the format from the first line that is not a comment, falling back to plain.
+func detectFormat(data []byte) rulesetFormat {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "[Adblock") {
+			return formatAdGuard
+		}
+		for _, option := range dnsmasqOptions {
+			if strings.HasPrefix(line, option+"/") {
+				return formatDnsmasq
+			}
+		}
+		if fields := strings.Fields(line); len(fields) > 1 {
+			if _, err := netip.ParseAddr(fields[0]); err == nil {
+				return formatHosts
+			}
+		}
+		return formatPlain
+	}
+	return formatPlain
+}
+
+// parseDnsmasq parses the domains of a dnsmasq option like server=/a.com/b.com/114.114.114.114, matching
+// the domains and their subdomains. Other options are skipped.
+func parseDnsmasq(line string) ([]Rule, error) {
+	for _, option := range dnsmasqOptions {
+		list, ok := strings.CutPrefix(line, option+"/")
+		if !ok {
+			continue
+		}
+		i := strings.LastIndexByte(list, '/')
+		if i < 0 {
+			return nil, nil
+		}
+
+		var rules []Rule
+		for _, domain := range strings.Split(list[:i], "/") {
+			if domain == "" || strings.Contains(domain, "*") {
+				continue
+			}
+			subrules, _ := parseRule(rulePrefixes[RuleDomain] + domain)
+			rules = append(rules, subrules...)
+		}
+		return rules, nil
+	}
+	return nil, nil
+}
+
+// parseAdGuard parses a DNS filtering rule of AdGuard or Adblock Plus: ||domain^ matches the domain and its
+// subdomains, |domain^ only the domain, /regexp/ the names matching it and @@ makes an exception. Hosts
+// lines and bare domains are accepted as well. Rules with modifiers other than $important, wildcards and
+// cosmetic rules are skipped, as they can't be expressed as a ruleset.
+func parseAdGuard(line string) ([]Rule, error) {
+	if len(line) == 0 || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+		return nil, nil
+	}
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#$#") {
+		return nil, nil
+	}
+	if fields := strings.Fields(line); len(fields) > 1 {
+		return parseHosts(line)
+	}
+
+	exclude := false
+	if rest, ok := strings.CutPrefix(line, "@@"); ok {
+		line, exclude = rest, true
+	}
+	// the $ of modifiers follows the rule, in /regexp/ it may be part of the rule
+	if i := strings.LastIndexByte(line, '$'); i >= 0 && !strings.Contains(line[i:], "/") {
+		if line[i+1:] != "important" {
+			return nil, nil
+		}
+		line = line[:i]
+	}
+
+	var typ RuleType
+	switch {
+	case len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/':
+		if exclude {
+			return nil, nil
+		}
+		typ, line = RuleRegexp, line[1:len(line)-1]
+	case strings.HasPrefix(line, "||"):
+		typ, line = RuleDomain, strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+	case strings.HasPrefix(line, "|"):
+		typ, line = RuleFull, strings.TrimSuffix(strings.TrimSuffix(line[1:], "|"), "^")
+	default:
+		typ, line = RuleDomain, strings.TrimSuffix(line, "^")
+	}
+	if typ != RuleRegexp && strings.ContainsAny(line, "*^|/:") {
+		return nil, nil
+	}
+
+	rule := rulePrefixes[typ] + line
+	if exclude {
+		rule = "!" + rule
+	}
+	if rules, err := parseRule(rule); err == nil {
+		return rules, nil
+	}
+	return nil, nil
+}
+
+// parseHosts parses a hosts line, "ADDRESS NAME...", each name matching only itself. Names without a dot,
+// like localhost, are skipped.
+func parseHosts(line string) ([]Rule, error) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, nil
+	}
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil, nil
+	}
+
+	var rules []Rule
+	for _, name := range fields[1:] {
+		if !strings.Contains(name, ".") {
+			continue
+		}
+		if _, err := netip.ParseAddr(name); err == nil {
+			continue
+		}
+		subrules, _ := parseRule(rulePrefixes[RuleFull] + name)
+		rules = append(rules, subrules...)
+	}
+	return rules, nil
+}
@@ -0,0 +1,121 @@
+package pforward
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestRulesetFormats(t *testing.T) {
+	tests := []struct {
+		content  string
+		format   rulesetFormat
+		expected map[string]bool
+	}{
+		{
+			"# felixonmars\nserver=/baidu.com/114.114.114.114\nserver=/qq.com/163.com/114.114.114.114\nserver=114.114.114.114\n",
+			formatDnsmasq,
+			map[string]bool{"www.baidu.com.": true, "qq.com.": true, "mail.163.com.": true, "google.com.": false},
+		},
+		{
+			"[Adblock Plus 2.0]\n! Title: test\n||ads.example.com^\n||tracker.example.net^$important\n|exact.example.org^\n@@||good.ads.example.com^\n/^ad[0-9]+\\.example\\.io$/\n||third.example.com^$third-party\n||*.wild.example.com^\nexample.##.banner\n0.0.0.0 hosts.example.com\n",
+			formatAdGuard,
+			map[string]bool{
+				"x.ads.example.com.":     true,
+				"good.ads.example.com.":  false,
+				"tracker.example.net.":   true,
+				"exact.example.org.":     true,
+				"www.exact.example.org.": false,
+				"ad12.example.io.":       true,
+				"third.example.com.":     false,
+				"a.wild.example.com.":    false,
+				"hosts.example.com.":     true,
+				"www.hosts.example.com.": false,
+				"unrelated.example.com.": false,
+			},
+		},
+		{
+			"127.0.0.1 localhost\n::1 localhost ip6-localhost\n0.0.0.0 0.0.0.0\n0.0.0.0 ads.example.com tracker.example.com # ads\n",
+			formatHosts,
+			map[string]bool{"ads.example.com.": true, "tracker.example.com.": true, "www.ads.example.com.": false, "localhost.": false},
+		},
+		{
+			"# plain\n!except.example.com\nexample.com\nfull:www.example.org\n",
+			formatPlain,
+			map[string]bool{"a.example.com.": true, "except.example.com.": false, "www.example.org.": true},
+		},
+	}
+	for i, tc := range tests {
+		if format := detectFormat([]byte(tc.content)); format != tc.format {
+			t.Errorf("Test %d: expected format %d, got %d", i, tc.format, format)
+		}
+
+		path := filepath.Join(t.TempDir(), "rules")
+		if err := os.WriteFile(path, []byte(tc.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := readRuleset(path)
+		if err != nil {
+			t.Fatalf("Test %d: failed to read ruleset: %s", i, err)
+		}
+		m, err := new(Matcher).Insert(rules)
+		if err != nil {
+			t.Fatalf("Test %d: failed to build matcher: %s", i, err)
+		}
+		for name, expected := range tc.expected {
+			if m.Match(name) != expected {
+				t.Errorf("Test %d: expected %s to match %t", i, name, expected)
+			}
+		}
+	}
+}
+
+func TestRulesetFormatDirective(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "china"), []byte("server=/baidu.com/114.114.114.114\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// the first line makes the detection pick plain
+	hosts := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hosts, []byte("ads.example.com\n0.0.0.0 tracker.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "rules")
+	if err := os.WriteFile(root, []byte("google.com\ninclude:china\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input    string
+		expected map[string]bool
+	}{
+		{"pforward " + root + " 127.0.0.1", map[string]bool{"google.com.": true, "www.baidu.com.": true}},
+		{"pforward " + hosts + " 127.0.0.1 {\nformat hosts\n}", map[string]bool{"tracker.example.com.": true, "ads.example.com.": false}},
+		{"pforward " + hosts + " 127.0.0.1 {\nformat adguard\n}", map[string]bool{"tracker.example.com.": true, "www.ads.example.com.": true}},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		for name, expected := range tc.expected {
+			if fs[0].from.Load().Match(name) != expected {
+				t.Errorf("Test %d: expected %s to match %t", i, name, expected)
+			}
+		}
+	}
+
+	for i, input := range []string{
+		"pforward " + hosts + " 127.0.0.1 {\nformat\n}",
+		"pforward " + hosts + " 127.0.0.1 {\nformat v2ray\n}",
+		"pforward . 127.0.0.1 {\nformat hosts\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, input)
+		}
+	}
+}
@@ -8,7 +8,8 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
+	"net/http"
+	"net/netip"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -37,21 +38,46 @@ const (
 type PForward struct {
 	concurrent int64 // atomic counters need to be first in struct for proper alignment
 
-	proxies    []*proxy.Proxy
+	proxies    []Upstream
+	weights    map[Upstream]int // only for weighted_round_robin, missing proxies weigh 1
 	p          Policy
 	hcInterval time.Duration
 
-	from atomic.Pointer[TrieNode]
+	from    atomic.Pointer[Matcher]
+	watcher *rulesetWatcher // FROM ruleset file, nil when FROM is inline
+	remote  *remoteRuleset  // FROM ruleset URL, nil when FROM is local
+	rules   []Rule          // inline FROM
+	except  []Rule
+
+	clients       atomic.Pointer[IPTrie]       // nil: any client
+	clientWatcher *fileWatcher[[]netip.Prefix] // from_client file, nil when there is none
+	clientCIDRs   []netip.Prefix               // inline from_client
+	qtypes        *qtypeSet                    // nil: any type
+	reload        *time.Duration               // nil: the default interval of the watchers
 
 	tlsConfig     *tls.Config
 	tlsServerName string
+	dohMethod     string
 	maxfails      uint32
 	expire        time.Duration
 	maxConcurrent int64
 
-	backupDuration time.Duration // duration=0: disabled
+	backupDuration   time.Duration // duration=0: disabled, the fallback delay in auto mode
+	backupPercentile float64       // percentile=0: static delay, otherwise auto mode
+	maxHedges        int
+	budget           *hedgeBudget // nil: unlimited
+	latencies        map[Upstream]*latencyHistogram
+
+	geoip *geoip // nil: disabled
+
+	egress    *egress    // nil: connect directly
+	bootstrap *bootstrap // resolves hostname upstreams, nil: none configured
 
-	opts proxy.Options // also here for testing
+	overrides map[string]*upstreamOpts // per upstream options by address
+	forceTCP  map[Upstream]bool        // upstreams with their own force_tcp
+
+	timeout time.Duration // of a request, across all upstreams and retries
+	opts    proxy.Options // also here for testing
 
 	// ErrLimitExceeded indicates that a query was rejected because the number of concurrent queries has exceeded
 	// the maximum allowed (maxConcurrent)
@@ -64,12 +90,12 @@ type PForward struct {
 
 // New returns a new Forward.
 func New() *PForward {
-	f := &PForward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), hcInterval: hcInterval, opts: proxy.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
+	f := &PForward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, timeout: defaultTimeout, p: new(random), hcInterval: hcInterval, dohMethod: http.MethodPost, weights: make(map[Upstream]int), overrides: make(map[string]*upstreamOpts), forceTCP: make(map[Upstream]bool), opts: proxy.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
 	return f
 }
 
 // SetProxy appends p to the proxy list and starts healthchecking.
-func (f *PForward) SetProxy(p *proxy.Proxy) {
+func (f *PForward) SetProxy(p Upstream) {
 	f.proxies = append(f.proxies, p)
 	p.Start(f.hcInterval)
 }
@@ -92,48 +118,138 @@ type TaskResult struct {
 	Result *dns.Msg
 	Err    error
 	Backup bool
+	Proxy  Upstream
 }
 
-func (f *PForward) ConnectWithTimeout(ctx context.Context, state request.Request, proxies []*proxy.Proxy, opts proxy.Options) (*dns.Msg, error) {
+// ConnectWithTimeout connects to proxies[0]. With backup_request it hedges to up to maxHedges of the
+// following healthy proxies, one more every backup delay while the budget allows, and returns the first
+// successful reply. All attempts share the deadline of ctx, the first success cancels the others and the
+// losers are drained in the background.
+func (f *PForward) ConnectWithTimeout(ctx context.Context, state request.Request, proxies []Upstream, opts proxy.Options) (*dns.Msg, error) {
 	if len(proxies) == 0 {
 		return nil, ErrNoForward
 	}
 	if f.backupDuration == 0 || len(proxies) == 1 {
-		return proxies[0].Connect(ctx, state, opts)
+		return f.connect(ctx, proxies[0], state, opts, false)
 	}
+	f.budget.deposit()
 
-	results := make(chan *TaskResult, len(proxies))
-	ctx, cancel := context.WithTimeout(ctx, f.backupDuration)
-	defer cancel()
-
-	go func() { // first request
-		ret, err := proxies[0].Connect(ctx, state, opts)
-		results <- &TaskResult{Result: ret, Err: err}
+	hedges := f.maxHedges
+	if hedges > len(proxies)-1 {
+		hedges = len(proxies) - 1
+	}
+	results := make(chan *TaskResult, hedges+1)
+
+	var (
+		pending = 0
+		next    = 1
+		lastErr error
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		if pending > 0 {
+			go f.drain(results, pending)
+		}
 	}()
 
-	go func() { // backup request
+	connect := func(p Upstream, backup bool) {
+		// Connect rewrites the message id, so every attempt gets its own copy.
+		state := state
+		state.Req = state.Req.Copy()
+		ret, err := f.connect(ctx, p, state, opts, true)
+		results <- &TaskResult{Result: ret, Err: err, Backup: backup, Proxy: p}
+	}
+
+	go connect(proxies[0], false)
+	pending++
+	timer := time.NewTimer(f.backupDelay(proxies[0]))
+	defer timer.Stop()
+
+	for pending > 0 {
 		select {
 		case <-ctx.Done():
-		case <-time.After(f.backupDuration):
-			ret, err := proxies[1].Connect(ctx, state, opts)
-			results <- &TaskResult{Result: ret, Err: err, Backup: true}
-		}
-	}()
+			return nil, ctx.Err()
+		case <-timer.C:
+			for next < len(proxies) && proxies[next].Down(f.maxfails) {
+				next++
+			}
+			if next == len(proxies) {
+				continue
+			}
+			if !f.budget.withdraw() {
+				hedgeSuppressedCount.Add(1)
+				continue
+			}
 
-	count := 0
-	for result := range results {
-		if result != nil && result.Err == nil {
+			go connect(proxies[next], true)
+			hedgeCount.Add(1)
+			pending++
+			if hedges--; hedges > 0 {
+				timer.Reset(f.backupDelay(proxies[next]))
+			}
+			next++
+		case result := <-results:
+			pending--
+			if result.Err != nil {
+				f.report(result)
+				lastErr = result.Err
+				continue
+			}
+
+			if result.Backup {
+				hedgeWonCount.Add(1)
+			}
 			metadata.SetValueFunc(ctx, "pforward/backup", func() string {
 				return strconv.FormatBool(result.Backup)
 			})
 			return result.Result, nil
 		}
-		if count++; count == 2 {
-			break
-		}
 	}
 
-	return nil, fmt.Errorf("all upstreams failed")
+	return nil, lastErr
+}
+
+// connect queries p, recording its latency for backup_request auto and the policy. A hedged attempt, on its
+// own copy of the request, returns as soon as ctx is done so the losers don't run on.
+func (f *PForward) connect(ctx context.Context, p Upstream, state request.Request, opts proxy.Options, hedged bool) (*dns.Msg, error) {
+	if t, ok := f.p.(tracker); ok {
+		t.acquire(p)
+		defer t.release(p)
+	}
+
+	if f.forceTCP[p] {
+		opts.ForceTCP = true
+	}
+	start := time.Now()
+	var (
+		ret *dns.Msg
+		err error
+	)
+	if hedged {
+		ret, err = connectAbandon(ctx, p, state, opts)
+	} else {
+		ret, err = p.Connect(ctx, state, opts)
+	}
+	rtt := time.Since(start)
+	// an attempt cut short by a cancellation or timeout took at least rtt, leaving it out skews the quantile low
+	if err == nil || cutShort(err) {
+		f.latencies[p].record(rtt)
+	}
+	if o, ok := f.p.(observer); ok {
+		o.observe(p, rtt, err)
+	}
+	return ret, err
+}
+
+// backupDelay returns how long to wait for p before hedging, the backupPercentile latency of p in auto mode.
+func (f *PForward) backupDelay(p Upstream) time.Duration {
+	if f.backupPercentile > 0 {
+		if d, ok := f.latencies[p].quantile(f.backupPercentile); ok {
+			return d
+		}
+	}
+	return f.backupDuration
 }
 
 // ServeDNS implements plugin.Handler. // TODO need refactoring
@@ -142,6 +258,13 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	if !f.match(state) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 	}
+	if !f.qtypes.Match(state.QType()) {
+		// qtype ... nodata: the name is ours, the type is not
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+		return dns.RcodeSuccess, nil
+	}
 
 	if f.maxConcurrent > 0 {
 		count := atomic.AddInt64(&(f.concurrent), 1)
@@ -157,8 +280,8 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	var upstreamErr error
 	span = ot.SpanFromContext(ctx)
 	i := 0
-	list := f.List()
-	deadline := time.Now().Add(defaultTimeout)
+	list := f.ListRequest(state)
+	deadline := time.Now().Add(f.timeout)
 	start := time.Now()
 	for time.Now().Before(deadline) && ctx.Err() == nil {
 		if i >= len(list) {
@@ -199,8 +322,9 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 		)
 		opts := f.opts
 
+		connectCtx, cancel := context.WithDeadline(ctx, deadline)
 		for {
-			ret, err = f.ConnectWithTimeout(ctx, state, currentProxies, opts)
+			ret, err = f.ConnectWithTimeout(connectCtx, state, currentProxies, opts)
 
 			if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
 				continue
@@ -212,6 +336,7 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 			}
 			break
 		}
+		cancel()
 
 		if child != nil {
 			child.Finish()
@@ -245,6 +370,12 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 			return 0, nil
 		}
 
+		// Answer landed on the wrong side of the geoip set, let the next stanza resolve it.
+		if f.geoip.reject(ret) {
+			geoipFallthroughCount.Add(1)
+			return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
+		}
+
 		metadata.SetValueFunc(ctx, "pforward/response/ip", func() string {
 			if ret == nil || len(ret.Answer) == 0 {
 				return "-"
@@ -272,8 +403,18 @@ func (f *PForward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	return dns.RcodeServerFailure, ErrNoHealthy
 }
 
+// match reports whether the stanza applies to the query, its name, type and client all have to match. With
+// qtype ... nodata the stanza applies to every type, ServeDNS answers the other types with NODATA.
 func (f *PForward) match(state request.Request) bool {
-	return FindDomainSuffix(state.Name(), f.from.Load())
+	if (!f.qtypes.Match(state.QType()) && !f.qtypes.Nodata()) || !f.from.Load().Match(state.Name()) {
+		return false
+	}
+	clients := f.clients.Load()
+	if clients == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(state.IP())
+	return err == nil && clients.Contains(addr)
 }
 
 // ForceTCP returns if TCP is forced to be used even when the request comes in over UDP.
@@ -283,7 +424,15 @@ func (f *PForward) ForceTCP() bool { return f.opts.ForceTCP }
 func (f *PForward) PreferUDP() bool { return f.opts.PreferUDP }
 
 // List returns a set of proxies to be used for this client depending on the policy in f.
-func (f *PForward) List() []*proxy.Proxy { return f.p.List(f.proxies) }
+func (f *PForward) List() []Upstream { return f.p.List(f.proxies) }
+
+// ListRequest is like List, but lets a RequestPolicy select the proxies for this request.
+func (f *PForward) ListRequest(state request.Request) []Upstream {
+	if p, ok := f.p.(RequestPolicy); ok {
+		return p.ListRequest(state, f.proxies)
+	}
+	return f.List()
+}
 
 var (
 	// ErrNoHealthy means no healthy proxies left.
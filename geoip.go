@@ -0,0 +1,207 @@
+package pforward
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IPTrie is a binary prefix trie holding a set of IPv4 and IPv6 networks.
+type IPTrie struct {
+	v4, v6 *ipNode
+}
+
+type ipNode struct {
+	Children [2]*ipNode
+
+	End bool
+}
+
+// Insert adds prefix to the set.
+func (t *IPTrie) Insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+
+	root := &t.v6
+	if addr.Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &ipNode{}
+	}
+
+	current := *root
+	raw := addr.AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		if current.End {
+			return
+		}
+
+		bit := raw[i/8] >> (7 - i%8) & 1
+		if current.Children[bit] == nil {
+			current.Children[bit] = &ipNode{}
+		}
+		current = current.Children[bit]
+	}
+
+	current.End = true
+	current.Children = [2]*ipNode{}
+}
+
+// Contains reports whether addr is covered by any prefix in the set.
+func (t *IPTrie) Contains(addr netip.Addr) bool {
+	if t == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+
+	current := t.v6
+	if addr.Is4() {
+		current = t.v4
+	}
+
+	raw := addr.AsSlice()
+	for i := 0; current != nil; i++ {
+		if current.End {
+			return true
+		}
+		if i == len(raw)*8 {
+			break
+		}
+		current = current.Children[raw[i/8]>>(7-i%8)&1]
+	}
+
+	return false
+}
+
+// readCIDRs reads a CIDR list, one network or address per line.
+func readCIDRs(path string) (*IPTrie, error) {
+	prefixes, err := readPrefixes(path, rulesetFiles{})
+	if err != nil {
+		return nil, err
+	}
+	return newIPTrie(prefixes), nil
+}
+
+// readPrefixes reads the networks of a CIDR list, or of a geoip.dat entry, and records the hash of the file
+// in files.
+func readPrefixes(path string, files rulesetFiles) ([]netip.Prefix, error) {
+	if spec, ok := strings.CutPrefix(path, geoipPrefix); ok {
+		return readGeoIP(spec, files)
+	}
+	path = filepath.Clean(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path=%s err=%v", path, err)
+	}
+	files[path] = sha256.Sum256(data)
+
+	prefixes := make([]netip.Prefix, 0)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		prefix, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr '%s' in %s: %v", line, path, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no cidr found in %s", path)
+	}
+
+	return prefixes, nil
+}
+
+// cidrPath resolves a relative CIDR list, or the file of a geoip.dat reference, against root.
+func cidrPath(path, root string) string {
+	prefix := ""
+	if spec, ok := strings.CutPrefix(path, geoipPrefix); ok {
+		prefix, path = geoipPrefix, spec
+	}
+	if !filepath.IsAbs(path) && root != "" {
+		path = filepath.Join(root, path)
+	}
+	return prefix + path
+}
+
+func newIPTrie(prefixes []netip.Prefix) *IPTrie {
+	trie := new(IPTrie)
+	for _, prefix := range prefixes {
+		trie.Insert(prefix)
+	}
+	return trie
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		// Contains unmaps the address, a 4in6 prefix only matches as an IPv4 one
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// geoip decides whether a reply should be handed over to the next stanza based on its answer addresses.
+type geoip struct {
+	path   string
+	inside bool // inside=true: fall through when the answer is inside the set, otherwise when it is outside
+	cidrs  *IPTrie
+}
+
+// reject reports whether ret must be discarded. Replies without A/AAAA answers are always kept.
+func (g *geoip) reject(ret *dns.Msg) bool {
+	if g == nil || ret == nil {
+		return false
+	}
+
+	found, inside := false, false
+	for _, ans := range ret.Answer {
+		var ip []byte
+		switch rr := ans.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		found = true
+		if g.cidrs.Contains(addr) {
+			inside = true
+			break
+		}
+	}
+
+	return found && inside == g.inside
+}
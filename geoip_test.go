@@ -0,0 +1,112 @@
+package pforward
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie := new(IPTrie)
+	for _, cidr := range []string{"1.0.1.0/24", "10.0.0.0/8", "10.1.0.0/16", "2400:da00::/32", "8.8.8.8", "::ffff:36.0.0.0/110"} {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Insert(prefix)
+	}
+
+	tests := map[string]bool{
+		"1.0.1.1":         true,
+		"1.0.2.1":         false,
+		"10.1.2.3":        true,
+		"10.255.0.1":      true,
+		"11.0.0.1":        false,
+		"8.8.8.8":         true,
+		"8.8.4.4":         false,
+		"::ffff:10.0.0.1": true,
+		"2400:da00::1":    true,
+		"2400:db00::1":    false,
+		"36.0.0.1":        true,
+		"::ffff:36.3.0.1": true,
+		"36.4.0.1":        false,
+	}
+	for ip, expected := range tests {
+		if got := trie.Contains(netip.MustParseAddr(ip)); got != expected {
+			t.Errorf("ip=%s expected=%v got=%v", ip, expected, got)
+		}
+	}
+}
+
+func TestGeoIPFallthrough(t *testing.T) {
+	cn := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch r.Question[0].Name {
+		case "cn.example.org.":
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 1.0.1.1"))
+		case "empty.example.org.":
+		default:
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+
+	foreign := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+
+	path := filepath.Join(t.TempDir(), "chnroute")
+	if err := os.WriteFile(path, []byte("# china\n1.0.1.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "pforward . "+cn+" {\ngeoip "+path+"\n}\npforward . "+foreign)
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	fs[0].Next = fs[1]
+	for _, f := range fs {
+		f.OnStartup()
+		defer f.OnShutdown()
+	}
+
+	tests := []struct {
+		name     string
+		expected int // number of answers
+		ip       string
+	}{
+		{"cn.example.org.", 1, "1.0.1.1"},
+		{"google.com.", 1, "127.0.0.2"},
+		{"empty.example.org.", 0, ""},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+		if _, err := fs[0].ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("name=%s expected to receive reply, but didn't: %v", tc.name, err)
+		}
+		if len(rec.Msg.Answer) != tc.expected {
+			t.Fatalf("name=%s expected %d answers, got %d", tc.name, tc.expected, len(rec.Msg.Answer))
+		}
+		if tc.expected > 0 {
+			if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != tc.ip {
+				t.Errorf("name=%s expected %s, got %s", tc.name, tc.ip, ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pforward
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	defaultHedgeRatio = 0.1 // at most 10% of the requests are hedged
+	hedgeBurst        = 10  // hedges allowed in a burst, and on startup
+)
+
+// hedgeBudget is a token bucket capping hedged requests to a ratio of all requests, every request deposits
+// ratio tokens and every hedge withdraws one. A nil budget is unlimited.
+type hedgeBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newHedgeBudget(ratio float64) *hedgeBudget {
+	return &hedgeBudget{ratio: ratio, tokens: hedgeBurst}
+}
+
+func (b *hedgeBudget) deposit() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > hedgeBurst {
+		b.tokens = hedgeBurst
+	}
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drain waits for the pending attempts of a hedged request that lost or were abandoned.
+func (f *PForward) drain(results <-chan *TaskResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.Err != nil {
+			f.report(result)
+		}
+	}
+}
+
+// report kicks off a health check for the upstream of a failed attempt, unless we cancelled it ourselves.
+// Latencies are recorded by connect for every attempt.
+func (f *PForward) report(result *TaskResult) {
+	if f.maxfails == 0 || errors.Is(result.Err, context.Canceled) {
+		return
+	}
+	result.Proxy.Healthcheck()
+}
@@ -0,0 +1,302 @@
+package pforward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestHedgeBudget(t *testing.T) {
+	b := newHedgeBudget(0.5)
+	for i := 0; i < hedgeBurst; i++ {
+		if !b.withdraw() {
+			t.Fatalf("expected burst hedge %d to be allowed", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("expected hedge to be suppressed after burst")
+	}
+
+	b.deposit()
+	if b.withdraw() {
+		t.Fatal("expected hedge to be suppressed after half a token")
+	}
+	b.deposit()
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatal("expected hedge to be allowed after a token")
+	}
+
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if b.tokens != hedgeBurst {
+		t.Errorf("expected tokens capped at %d, got %f", hedgeBurst, b.tokens)
+	}
+
+	var unlimited *hedgeBudget
+	unlimited.deposit()
+	if !unlimited.withdraw() {
+		t.Error("expected nil budget to be unlimited")
+	}
+}
+
+func newHedgeServer(t *testing.T, delay time.Duration, ip string) string {
+	return newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A "+ip))
+		w.WriteMsg(ret)
+	})
+}
+
+func TestHedgeMultiWay(t *testing.T) {
+	slow1 := newHedgeServer(t, 500*time.Millisecond, "127.0.0.1")
+	slow2 := newHedgeServer(t, 500*time.Millisecond, "127.0.0.2")
+	fast := newHedgeServer(t, 0, "127.0.0.3")
+
+	c := caddy.NewTestController("dns", "pforward . "+slow1+" "+slow2+" "+fast+" {\npolicy sequential\nbackup_request 50ms 2 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.timeout = 5 * time.Second
+	if f.maxHedges != 2 || f.budget == nil || f.budget.ratio != 1 {
+		t.Fatalf("unexpected backup_request config: max_hedges=%d budget=%+v", f.maxHedges, f.budget)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	start := time.Now()
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected second hedge to answer in ~100ms, took %s", elapsed)
+	}
+	if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != "127.0.0.3" {
+		t.Errorf("expected answer from the second hedge, got %s", ip)
+	}
+}
+
+func TestHedgeSuppressed(t *testing.T) {
+	slow := newHedgeServer(t, 200*time.Millisecond, "127.0.0.1")
+	fast := newHedgeServer(t, 0, "127.0.0.2")
+
+	c := caddy.NewTestController("dns", "pforward . "+slow+" "+fast+" {\npolicy sequential\nbackup_request 20ms 1 0.01\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.timeout = 5 * time.Second
+	f.OnStartup()
+	defer f.OnShutdown()
+	f.budget.tokens = 0
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != "127.0.0.1" {
+		t.Errorf("expected hedge to be suppressed and answer from primary, got %s", ip)
+	}
+}
+
+func TestBackupRequestParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"backup_request 2s", false},
+		{"backup_request 2s 3", false},
+		{"backup_request 2s 3 0.2", false},
+		{"backup_request", true},
+		{"backup_request 2s 0", true},
+		{"backup_request 2s 1 0", true},
+		{"backup_request 2s 1 0.1 x", true},
+		{"backup_request -1s", true},
+		{"backup_request auto p95", false},
+		{"backup_request auto p99.9 2 0.5", false},
+		{"backup_request auto", true},
+		{"backup_request auto 95", true},
+		{"backup_request auto p95 0", true},
+	}
+	for _, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\n"+tc.input+"\n}")
+		_, err := parseForward(c)
+		if (err != nil) != tc.shouldErr {
+			t.Errorf("input=%q expected error=%v got %v", tc.input, tc.shouldErr, err)
+		}
+	}
+}
+
+func TestHedgeKeepsPrimary(t *testing.T) {
+	primary := newHedgeServer(t, 100*time.Millisecond, "127.0.0.1")
+	backup := newHedgeServer(t, 400*time.Millisecond, "127.0.0.2")
+
+	c := caddy.NewTestController("dns", "pforward . "+primary+" "+backup+" {\npolicy sequential\nbackup_request 20ms 1 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.timeout = 5 * time.Second
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	start := time.Now()
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != "127.0.0.1" {
+		t.Errorf("expected primary to keep running after the hedge fired, got answer from %s", ip)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("expected primary answer in ~100ms, took %s", elapsed)
+	}
+}
+
+func TestHedgeDeadline(t *testing.T) {
+	slow1 := newHedgeServer(t, 300*time.Millisecond, "127.0.0.1")
+	slow2 := newHedgeServer(t, 300*time.Millisecond, "127.0.0.2")
+
+	c := caddy.NewTestController("dns", "pforward . "+slow1+" "+slow2+" {\npolicy sequential\nbackup_request 10ms 1 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.ConnectWithTimeout(ctx, state, f.proxies, f.opts); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected to give up at the request deadline, took %s", elapsed)
+	}
+}
+
+func TestHedgeCancelsLoser(t *testing.T) {
+	loser := newHedgeServer(t, time.Second, "127.0.0.1")
+	winner := newHedgeServer(t, 100*time.Millisecond, "127.0.0.2")
+
+	c := caddy.NewTestController("dns", "pforward . "+loser+" "+winner+" {\npolicy least_outstanding\nbackup_request 20ms 1 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	ret, err := f.ConnectWithTimeout(ctx, state, f.proxies, f.opts)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if ip := ret.Answer[0].(*dns.A).A.String(); ip != "127.0.0.2" {
+		t.Fatalf("expected the answer of the winner, got %s", ip)
+	}
+
+	// the loser is a proxy.Proxy, which ignores ctx, its attempt must still return with the winner
+	won := time.Now()
+	inflight := f.p.(*leastOutstanding).counter(f.proxies[0])
+	for atomic.LoadInt64(inflight) != 0 {
+		if time.Since(won) > 300*time.Millisecond {
+			t.Fatalf("expected the loser to return right after the winner, still in flight after %s", time.Since(won))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHedgeDrain(t *testing.T) {
+	var healthchecks uint32
+	primary := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "." {
+			atomic.AddUint32(&healthchecks, 1)
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		}
+		// drop queries, the primary times out before the hedges answer
+	})
+	slow := newHedgeServer(t, 300*time.Millisecond, "127.0.0.2")
+	fast := newHedgeServer(t, 100*time.Millisecond, "127.0.0.3")
+
+	c := caddy.NewTestController("dns", "pforward . "+primary+" "+slow+" "+fast+" {\npolicy sequential\nbackup_request auto p95 2 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.timeout = 5 * time.Second
+	f.backupDuration = 10 * time.Millisecond
+	f.proxies[0].SetReadTimeout(50 * time.Millisecond)
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != "127.0.0.3" {
+		t.Fatalf("expected answer from the fast hedge, got %s", ip)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadUint32(&healthchecks); n == 0 {
+		t.Error("expected the timed out loser to trigger a health check")
+	}
+	// the cancelled and the timed out loser record their duration as a lower bound of their latency
+	for i, min := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} {
+		h := f.latencies[f.proxies[i]]
+		h.mu.Lock()
+		if h.total != 1 {
+			t.Errorf("expected the latency of loser %d to be recorded, got %d samples", i, h.total)
+		}
+		for _, count := range h.counts[:latencyBucket(min)] {
+			if count != 0 {
+				t.Errorf("expected the latency of loser %d to be at least %s", i, min)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,339 @@
+package pforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	minBootstrapTTL = 10 * time.Second // re-resolving more often only adds load
+	bootstrapRetry  = 5 * time.Second  // how long until a failed resolution is retried
+)
+
+// bootstrap resolves the names of hostname upstreams with plain DNS servers, tried in order.
+type bootstrap struct {
+	servers []string // host:port
+	dial    dialFunc
+	tcp     bool // dial can't carry UDP, like an HTTP egress
+}
+
+// resolve returns the A and AAAA addresses of host and the lowest TTL of them. Every server gets timeout
+// to answer, within the deadline of ctx.
+func (b *bootstrap) resolve(ctx context.Context, host string, timeout time.Duration) ([]net.IP, time.Duration, error) {
+	var (
+		ips    []net.IP
+		ttl    time.Duration
+		failed uint16 // the type that failed, the addresses of the other one are still good
+		err    error
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ret, qerr := b.exchange(ctx, host, qtype, timeout)
+		if qerr != nil {
+			failed, err = qtype, qerr
+			continue
+		}
+		for _, rr := range ret.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue // the CNAME chain
+			}
+			ips = append(ips, ip)
+			if d := time.Duration(rr.Header().Ttl) * time.Second; ttl == 0 || d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("bootstrap: no addresses for %s", host)
+	}
+	if err != nil {
+		log.Warningf("Failed to resolve %s of %s, using the other addresses: %v", dns.TypeToString[failed], host, err)
+	}
+	if ttl < minBootstrapTTL {
+		ttl = minBootstrapTTL
+	}
+	return ips, ttl, nil
+}
+
+// exchange asks the servers in order until one answers, each one within timeout.
+func (b *bootstrap) exchange(ctx context.Context, host string, qtype uint16, timeout time.Duration) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	var err error
+	for _, server := range b.servers {
+		var ret *dns.Msg
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		if b.tcp {
+			ret, err = b.exchangeWith(ctx, m, server, "tcp")
+		} else if ret, err = b.exchangeWith(ctx, m, server, "udp"); err == nil && ret.Truncated {
+			ret, err = b.exchangeWith(ctx, m, server, "tcp")
+		}
+		cancel()
+		if err != nil {
+			continue
+		}
+		if ret.Rcode != dns.RcodeSuccess && ret.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("bootstrap: %s from %s for %s", dns.RcodeToString[ret.Rcode], server, host)
+			continue
+		}
+		return ret, nil
+	}
+	return nil, err
+}
+
+func (b *bootstrap) exchangeWith(ctx context.Context, m *dns.Msg, server, proto string) (*dns.Msg, error) {
+	conn, err := b.dial(ctx, proto, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultReadTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	co := &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	for {
+		ret, err := co.ReadMsg()
+		if err != nil || ret.Id == m.Id {
+			return ret, err
+		}
+	}
+}
+
+var errNoAddresses = errors.New("hostname not resolved yet")
+
+// hostProxy is an upstream given by hostname. Every address the name resolves to becomes an upstream of
+// its own with its own health, queries go to the healthy ones in turn. The name is resolved again when
+// the TTL of its addresses runs out, the old upstreams serve until then.
+type hostProxy struct {
+	addr     string // hostname:port
+	host     string
+	port     string
+	resolver *bootstrap
+	maxfails uint32
+	// spawn returns the upstream for one address of the name
+	spawn func(addr string) Upstream
+
+	hcInterval  time.Duration
+	readTimeout time.Duration
+	robin       uint32
+
+	mu        sync.Mutex
+	proxies   []Upstream
+	expires   time.Time
+	resolving chan struct{} // closed when the resolution in flight is done, nil: none
+	started   bool
+}
+
+func newHostProxy(addr string) *hostProxy {
+	host, port, _ := net.SplitHostPort(addr)
+	return &hostProxy{addr: addr, host: host, port: port, readTimeout: defaultReadTimeout}
+}
+
+func (p *hostProxy) Addr() string { return p.addr }
+
+func (p *hostProxy) SetReadTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = d
+	for _, c := range p.proxies {
+		c.SetReadTimeout(d)
+	}
+}
+
+// Start starts the health checks of the resolved upstreams, the name is resolved in the background.
+func (p *hostProxy) Start(hcInterval time.Duration) {
+	p.mu.Lock()
+	p.hcInterval, p.started = hcInterval, true
+	for _, c := range p.proxies {
+		c.Start(hcInterval)
+	}
+	p.mu.Unlock()
+
+	go p.refresh()
+}
+
+func (p *hostProxy) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = false
+	for _, c := range p.proxies {
+		c.Stop()
+	}
+}
+
+func (p *hostProxy) Healthcheck() {
+	for _, c := range p.current() {
+		c.Healthcheck()
+	}
+}
+
+// Down returns true when all addresses are down, before the name is resolved it is not.
+func (p *hostProxy) Down(maxfails uint32) bool {
+	proxies := p.current()
+	for _, c := range proxies {
+		if !c.Down(maxfails) {
+			return false
+		}
+	}
+	return len(proxies) > 0
+}
+
+// Connect sends the request to the next healthy address, resolving the name first when needed.
+func (p *hostProxy) Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	proxies := p.current()
+	if len(proxies) == 0 {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+		if proxies = p.current(); len(proxies) == 0 {
+			return nil, errNoAddresses
+		}
+	}
+
+	i := atomic.AddUint32(&p.robin, 1)
+	c := proxies[i%uint32(len(proxies))]
+	for j := range proxies {
+		if next := proxies[(i+uint32(j))%uint32(len(proxies))]; !next.Down(p.maxfails) {
+			c = next
+			break
+		}
+	}
+	return c.Connect(ctx, state, opts)
+}
+
+// current returns the upstreams of the addresses, kicking off a refresh when they expired.
+func (p *hostProxy) current() []Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resolving == nil && len(p.proxies) > 0 && time.Now().After(p.expires) {
+		p.expires = time.Now().Add(bootstrapRetry) // one refresh at a time
+		go p.refresh()
+	}
+	return p.proxies
+}
+
+// refresh resolves the name and replaces the upstreams of addresses that went away. When a resolution
+// is in flight it waits for that one.
+func (p *hostProxy) refresh() error {
+	p.mu.Lock()
+	if done := p.resolving; done != nil {
+		p.mu.Unlock()
+		<-done
+		return nil
+	}
+	done := make(chan struct{})
+	p.resolving = done
+	timeout := p.readTimeout
+	p.mu.Unlock()
+	defer close(done)
+
+	ips, ttl, err := p.resolver.resolve(context.Background(), p.host, timeout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolving = nil
+	if err != nil {
+		// keep what we have, try again soon
+		log.Warningf("Failed to resolve upstream %s: %v", p.addr, err)
+		p.expires = time.Now().Add(bootstrapRetry)
+		return err
+	}
+	p.expires = time.Now().Add(ttl)
+
+	old := make(map[string]Upstream, len(p.proxies))
+	for _, c := range p.proxies {
+		old[c.Addr()] = c
+	}
+	proxies := make([]Upstream, 0, len(ips))
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), p.port)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if c, ok := old[addr]; ok {
+			proxies = append(proxies, c)
+			delete(old, addr)
+			continue
+		}
+		c := p.spawn(addr)
+		c.SetReadTimeout(p.readTimeout)
+		if p.started {
+			c.Start(p.hcInterval)
+		}
+		proxies = append(proxies, c)
+	}
+	for _, c := range old {
+		if p.started {
+			c.Stop()
+		}
+	}
+	p.proxies = proxies
+	return nil
+}
+
+// hostnameSpec returns the spec of an upstream given by hostname, ok is false for IP addresses and
+// resolv.conf like files.
+func hostnameSpec(addr, path string) (upstreamSpec, bool) {
+	trans, host := parse.Transport(addr)
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, transportPort(trans)
+	}
+	name = strings.TrimSuffix(name, ".")
+	if port == "" || net.ParseIP(name) != nil || !strings.Contains(name, ".") || strings.ContainsAny(name, "/%") {
+		return upstreamSpec{}, false
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return upstreamSpec{}, false
+	}
+	if _, err := os.Stat(host); err == nil {
+		return upstreamSpec{}, false
+	}
+	return upstreamSpec{trans: trans, addr: net.JoinHostPort(name, port), path: path, hostname: name}, true
+}
+
+// transportPort returns the default port of trans.
+func transportPort(trans string) string {
+	switch trans {
+	case transport.DNS:
+		return transport.Port
+	case transport.TLS:
+		return transport.TLSPort
+	case transport.HTTPS:
+		return transport.HTTPSPort
+	case transport.QUIC:
+		return transport.QUICPort
+	}
+	return ""
+}
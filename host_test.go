@@ -0,0 +1,208 @@
+package pforward
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newBootstrapServer answers A queries for dns.example.org. with the address in ip.
+func newBootstrapServer(t *testing.T, ip *atomic.Value) string {
+	return newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "dns.example.org." && r.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer,
+				test.CNAME("dns.example.org. 300 IN CNAME edge.example.org."),
+				test.A("edge.example.org. 60 IN A "+ip.Load().(string)),
+			)
+		}
+		w.WriteMsg(ret)
+	})
+}
+
+func TestHostname(t *testing.T) {
+	defaultTimeout = 5 * time.Second
+
+	var ip atomic.Value
+	ip.Store("127.0.0.1")
+	boot := newBootstrapServer(t, &ip)
+	upstream := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	_, port, _ := net.SplitHostPort(upstream)
+
+	c := caddy.NewTestController("dns", "pforward . dns.example.org:"+port+" {\nbootstrap "+boot+"\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	p, ok := f.proxies[0].(*hostProxy)
+	if !ok || p.Addr() != "dns.example.org:"+port {
+		t.Fatalf("expected hostname upstream dns.example.org:%s, got %T %s", port, f.proxies[0], f.proxies[0].Addr())
+	}
+
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// the first query waits for the name to resolve
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", rec.Msg)
+	}
+	proxies := p.current()
+	if len(proxies) != 1 || proxies[0].Addr() != upstream {
+		t.Fatalf("expected the resolved upstream %s, got %v", upstream, proxies)
+	}
+	p.mu.Lock()
+	ttl := time.Until(p.expires)
+	p.mu.Unlock()
+	if ttl <= 50*time.Second || ttl > 60*time.Second {
+		t.Errorf("expected the TTL of the address, got %s", ttl)
+	}
+
+	// the name moved, the upstream follows once the TTL ran out
+	ip.Store("127.0.0.2")
+	p.current()
+	if proxies := p.current(); proxies[0].Addr() != upstream {
+		t.Errorf("expected the upstream to stay until the TTL runs out, got %s", proxies[0].Addr())
+	}
+	p.mu.Lock()
+	p.expires = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+	p.current()
+	expected := net.JoinHostPort("127.0.0.2", port)
+	for i := 0; i < 100; i++ {
+		if proxies := p.current(); proxies[0].Addr() == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the upstream to move to %s, got %s", expected, p.current()[0].Addr())
+}
+
+func TestHostnameServerName(t *testing.T) {
+	var ip atomic.Value
+	ip.Store("127.0.0.1")
+	boot := newBootstrapServer(t, &ip)
+
+	tests := []struct {
+		input      string
+		serverName string
+		url        string
+	}{
+		{"pforward . https://dns.example.org {\nbootstrap " + boot + "\n}", "dns.example.org", "https://dns.example.org/dns-query"},
+		{"pforward . https://dns.example.org:8443/q {\nbootstrap " + boot + "\n}", "dns.example.org", "https://dns.example.org:8443/q"},
+		{"pforward . https://dns.example.org {\nbootstrap " + boot + "\ntls_servername other.example.org\n}", "other.example.org", "https://dns.example.org/dns-query"},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		p := fs[0].proxies[0].(*hostProxy)
+		if err := p.refresh(); err != nil {
+			t.Fatalf("Test %d: failed to resolve: %s", i, err)
+		}
+		doh := p.current()[0].(*dohProxy)
+		if name := doh.transport.TLSClientConfig.ServerName; name != tc.serverName {
+			t.Errorf("Test %d: expected server name %s, got %s", i, tc.serverName, name)
+		}
+		if doh.url != tc.url {
+			t.Errorf("Test %d: expected URL %s, got %s", i, tc.url, doh.url)
+		}
+	}
+}
+
+func TestBootstrapTimeout(t *testing.T) {
+	var ip atomic.Value
+	ip.Store("127.0.0.1")
+	dead := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	boot := newBootstrapServer(t, &ip)
+
+	c := caddy.NewTestController("dns", "pforward . dns.example.org {\nbootstrap "+dead+" "+boot+"\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	p := fs[0].proxies[0].(*hostProxy)
+	p.SetReadTimeout(200 * time.Millisecond)
+
+	// the dead server takes its own timeout, not the time of the next one
+	if err := p.refresh(); err != nil {
+		t.Fatalf("expected the second bootstrap server to answer, got %v", err)
+	}
+	if n := len(p.current()); n != 1 {
+		t.Errorf("expected 1 address, got %d", n)
+	}
+}
+
+func TestBootstrapPartial(t *testing.T) {
+	boot := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			ret.Rcode = dns.RcodeServerFailure
+		} else {
+			ret.Answer = append(ret.Answer, test.A("dns.example.org. 60 IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+
+	b := &bootstrap{servers: []string{boot}, dial: new(net.Dialer).DialContext}
+	ips, _, err := b.resolve(context.TODO(), "dns.example.org", time.Second)
+	if err != nil {
+		t.Fatalf("expected the A addresses despite the failed AAAA query, got %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected 127.0.0.1, got %v", ips)
+	}
+}
+
+func TestHostnameParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		addr      string
+	}{
+		{"pforward . tls://dns.google {\nbootstrap 8.8.8.8\n}", false, "dns.google:853"},
+		{"pforward . dns.google. {\nbootstrap 8.8.8.8:53 1.1.1.1\n}", false, "dns.google:53"},
+		{"pforward . quic://dns.adguard-dns.com:784 {\nbootstrap 8.8.8.8\n}", false, "dns.adguard-dns.com:784"},
+		{"pforward . tls://dns.google^3 {\nbootstrap 8.8.8.8\npolicy weighted_round_robin\n}", false, "dns.google:853"},
+		{"pforward . tls://dns.google", true, ""},
+		{"pforward . tls://dns.google {\nbootstrap tls://8.8.8.8\n}", true, ""},
+		{"pforward . tls://dns.google {\nbootstrap\n}", true, ""},
+		{"pforward . grpc://dns.google {\nbootstrap 8.8.8.8\n}", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Fatalf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := fs[0].proxies[0].(*hostProxy); !ok || fs[0].proxies[0].Addr() != test.addr {
+			t.Errorf("Test %d: expected hostname upstream %s, got %T %s", i, test.addr, fs[0].proxies[0], fs[0].proxies[0].Addr())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package pforward
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	latencyMin        = 100 * time.Microsecond
+	latencyGrowth     = 1.1  // each bucket is 10% wider than the previous one
+	latencyBuckets    = 140  // up to ~60s
+	latencyDecay      = 1024 // counts are halved once this many samples are recorded
+	latencyMinSamples = 20   // fewer samples than this give no quantile
+
+	autoBackupFallback = 500 * time.Millisecond // backup delay in auto mode until enough samples are recorded
+)
+
+// latencyHistogram is a streaming histogram of upstream latencies with log-scaled buckets. Counts are decayed
+// so quantiles follow the recent latency of the upstream.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts [latencyBuckets]uint32
+	total  uint32
+}
+
+func latencyBucket(d time.Duration) int {
+	if d <= latencyMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(latencyMin)) / math.Log(latencyGrowth)))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := latencyBucket(d)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	if h.total++; h.total < latencyDecay {
+		return
+	}
+
+	h.total = 0
+	for i := range h.counts {
+		h.counts[i] /= 2
+		h.total += h.counts[i]
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the q quantile, 0 < q < 1.
+func (h *latencyHistogram) quantile(q float64) (time.Duration, bool) {
+	if h == nil {
+		return 0, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total < latencyMinSamples {
+		return 0, false
+	}
+
+	rank := uint32(math.Ceil(q * float64(h.total)))
+	var seen uint32
+	for i, count := range h.counts {
+		if seen += count; seen >= rank {
+			return time.Duration(float64(latencyMin) * math.Pow(latencyGrowth, float64(i))), true
+		}
+	}
+	return time.Duration(float64(latencyMin) * math.Pow(latencyGrowth, latencyBuckets-1)), true
+}
+
+// cutShort reports whether an attempt failed because it was cancelled or timed out, not because the
+// upstream answered with an error, so its duration is a lower bound of the latency.
+func cutShort(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
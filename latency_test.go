@@ -0,0 +1,121 @@
+package pforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := new(latencyHistogram)
+	if _, ok := h.quantile(0.95); ok {
+		t.Fatal("expected no quantile without samples")
+	}
+
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	for q, expected := range map[float64]time.Duration{0.5: 50 * time.Millisecond, 0.95: 95 * time.Millisecond, 0.99: 99 * time.Millisecond} {
+		d, ok := h.quantile(q)
+		if !ok {
+			t.Fatalf("q=%v expected quantile", q)
+		}
+		if d < expected || d > expected*11/10 {
+			t.Errorf("q=%v expected ~%s, got %s", q, expected, d)
+		}
+	}
+
+	// old samples decay away
+	for i := 0; i < 4*latencyDecay; i++ {
+		h.record(time.Second)
+	}
+	if d, _ := h.quantile(0.5); d < time.Second {
+		t.Errorf("expected median to follow recent samples, got %s", d)
+	}
+}
+
+func TestCutShort(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{context.Canceled, true},
+		{fmt.Errorf("exchange: %w", context.DeadlineExceeded), true},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}, true},
+		{&net.OpError{Op: "dial", Net: "udp", Err: errors.New("connection refused")}, false},
+		{ErrNoHealthy, false},
+	}
+	for i, tc := range tests {
+		if got := cutShort(tc.err); got != tc.expected {
+			t.Errorf("Test %d: expected %t for %v, got %t", i, tc.expected, tc.err, got)
+		}
+	}
+}
+
+func TestParsePercentile(t *testing.T) {
+	tests := map[string]float64{"p95": 0.95, "p99.9": 0.999, "p50": 0.5}
+	for s, expected := range tests {
+		if got, err := parsePercentile(s); err != nil || math.Abs(got-expected) > 1e-9 {
+			t.Errorf("s=%s expected %v, got %v err=%v", s, expected, got, err)
+		}
+	}
+	for _, s := range []string{"95", "p0", "p100", "px"} {
+		if _, err := parsePercentile(s); err == nil {
+			t.Errorf("s=%s expected error", s)
+		}
+	}
+}
+
+func TestHedgeAuto(t *testing.T) {
+	slow := newHedgeServer(t, 300*time.Millisecond, "127.0.0.1")
+	fast := newHedgeServer(t, 0, "127.0.0.2")
+
+	c := caddy.NewTestController("dns", "pforward . "+slow+" "+fast+" {\npolicy sequential\nbackup_request auto p95 1 1\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.timeout = 5 * time.Second
+	if f.backupPercentile != 0.95 || f.backupDuration != autoBackupFallback || f.maxHedges != 1 {
+		t.Fatalf("unexpected backup_request config: percentile=%v duration=%s max_hedges=%d", f.backupPercentile, f.backupDuration, f.maxHedges)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	if d := f.backupDelay(f.proxies[0]); d != autoBackupFallback {
+		t.Errorf("expected fallback delay without samples, got %s", d)
+	}
+	for i := 0; i < 100; i++ {
+		f.latencies[f.proxies[0]].record(10 * time.Millisecond)
+	}
+	if d := f.backupDelay(f.proxies[0]); d < 10*time.Millisecond || d > 11*time.Millisecond {
+		t.Errorf("expected p95 delay ~10ms, got %s", d)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	start := time.Now()
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected hedge after ~10ms, took %s", elapsed)
+	}
+	if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != "127.0.0.2" {
+		t.Errorf("expected answer from the hedge, got %s", ip)
+	}
+}
@@ -0,0 +1,201 @@
+package pforward
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RuleType is the kind of a ruleset entry.
+type RuleType int
+
+const (
+	RuleDomain  RuleType = iota // domain and its subdomains, the default
+	RuleFull                    // exactly the domain
+	RuleKeyword                 // domains containing the keyword
+	RuleRegexp                  // domains matching the regular expression
+)
+
+var rulePrefixes = map[RuleType]string{
+	RuleDomain:  "domain:",
+	RuleFull:    "full:",
+	RuleKeyword: "keyword:",
+	RuleRegexp:  "regexp:",
+}
+
+// Rule is a single normalized ruleset entry.
+type Rule struct {
+	Type    RuleType
+	Value   string
+	Exclude bool // only for RuleDomain and RuleFull
+}
+
+// Matcher matches query names against domain, full, keyword and regexp rules.
+type Matcher struct {
+	domains  *TrieNode
+	full     map[string]bool // value=false: excluded
+	keywords []string
+	regexps  []*regexp.Regexp
+
+	automaton *acNode // built from keywords
+}
+
+// Insert adds rules to m, creating m if needed.
+func (m *Matcher) Insert(rules []Rule) (*Matcher, error) {
+	if m == nil {
+		m = &Matcher{}
+	}
+
+	rebuild := false
+	for _, rule := range rules {
+		switch rule.Type {
+		case RuleDomain:
+			if rule.Exclude {
+				m.domains = ExcludeDomain(rule.Value, m.domains)
+			} else {
+				m.domains = InsertDomain(rule.Value, m.domains)
+			}
+		case RuleFull:
+			if m.full == nil {
+				m.full = make(map[string]bool)
+			}
+			if matched, ok := m.full[rule.Value]; !ok || matched {
+				m.full[rule.Value] = !rule.Exclude
+			}
+		case RuleKeyword:
+			m.keywords = append(m.keywords, rule.Value)
+			rebuild = true
+		case RuleRegexp:
+			re, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return m, err
+			}
+			m.regexps = append(m.regexps, re)
+		}
+	}
+	if rebuild {
+		m.automaton = buildAutomaton(m.keywords)
+	}
+
+	return m, nil
+}
+
+// Match reports whether name is matched. Full rules win over domain rules, and an excluded domain is never
+// matched by keyword or regexp rules.
+func (m *Matcher) Match(name string) bool {
+	if m == nil {
+		return false
+	}
+
+	if matched, ok := m.full[name]; ok {
+		return matched
+	}
+	if matched, found := lookupDomainSuffix(name, m.domains); found {
+		return matched
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	if m.automaton.match(name) {
+		return true
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Format returns all rules of m, prefixed by their type except for domain rules.
+func (m *Matcher) Format() []string {
+	if m == nil {
+		return nil
+	}
+
+	results := Format(m.domains)
+	for name, matched := range m.full {
+		if matched {
+			results = append(results, rulePrefixes[RuleFull]+name)
+		} else {
+			results = append(results, "!"+rulePrefixes[RuleFull]+name)
+		}
+	}
+	for _, keyword := range m.keywords {
+		results = append(results, rulePrefixes[RuleKeyword]+keyword)
+	}
+	for _, re := range m.regexps {
+		results = append(results, rulePrefixes[RuleRegexp]+re.String())
+	}
+
+	return results
+}
+
+// acNode is a state of the Aho-Corasick automaton used for keyword rules.
+type acNode struct {
+	next map[byte]*acNode
+	fail *acNode
+	out  bool // a keyword ends here or at one of the fail states
+}
+
+func buildAutomaton(keywords []string) *acNode {
+	root := &acNode{next: make(map[byte]*acNode)}
+	for _, keyword := range keywords {
+		current := root
+		for i := 0; i < len(keyword); i++ {
+			next := current.next[keyword[i]]
+			if next == nil {
+				next = &acNode{next: make(map[byte]*acNode)}
+				current.next[keyword[i]] = next
+			}
+			current = next
+		}
+		current.out = true
+	}
+
+	queue := make([]*acNode, 0, len(root.next))
+	for _, next := range root.next {
+		next.fail = root
+		queue = append(queue, next)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for c, next := range current.next {
+			fail := current.fail
+			for fail != nil && fail.next[c] == nil {
+				fail = fail.fail
+			}
+			if fail == nil {
+				next.fail = root
+			} else {
+				next.fail = fail.next[c]
+			}
+			next.out = next.out || next.fail.out
+			queue = append(queue, next)
+		}
+	}
+
+	return root
+}
+
+func (root *acNode) match(s string) bool {
+	if root == nil {
+		return false
+	}
+
+	current := root
+	for i := 0; i < len(s); i++ {
+		for current != root && current.next[s[i]] == nil {
+			current = current.fail
+		}
+		if next := current.next[s[i]]; next != nil {
+			current = next
+		}
+		if current.out {
+			return true
+		}
+	}
+
+	return false
+}
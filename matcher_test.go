@@ -0,0 +1,85 @@
+package pforward
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutomaton(t *testing.T) {
+	root := buildAutomaton([]string{"he", "she", "his", "hers", "abcd", "bc"})
+
+	tests := map[string]bool{
+		"ushers": true,
+		"ahis":   true,
+		"xbcx":   true,
+		"abxd":   false,
+		"ab":     false,
+		"":       false,
+		"hhhhs":  false,
+		"shx":    false,
+		"xxabcd": true,
+	}
+	for s, expected := range tests {
+		if got := root.match(s); got != expected {
+			t.Errorf("s=%s expected=%v got=%v", s, expected, got)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	ruleset := `
+# suffix
+google.com
+domain:youtube.com
+!ads.youtube.com
+full:example.org
+!full:www.google.com
+keyword:netflix
+regexp:^(www\.)?twitch\.tv$
+`
+	if err := os.WriteFile(path, []byte(ruleset), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := readRuleset(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := new(Matcher).Insert(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("rules=%+v", m.Format())
+
+	tests := map[string]bool{
+		"google.com.":            true,
+		"mail.google.com.":       true,
+		"www.google.com.":        false,
+		"a.www.google.com.":      true,
+		"youtube.com.":           true,
+		"ads.youtube.com.":       false,
+		"example.org.":           true,
+		"www.example.org.":       false,
+		"netflix.com.":           true,
+		"api.netflixdnstest.io.": true,
+		"twitch.tv.":             true,
+		"www.twitch.tv.":         true,
+		"api.twitch.tv.":         false,
+		"example.com.":           false,
+	}
+	for domain, expected := range tests {
+		if got := m.Match(domain); got != expected {
+			t.Errorf("domain=%s expected=%v got=%v", domain, expected, got)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, line := range []string{"regexp:(", "keyword:", "full:www..example.com", "!keyword:google", "except:regexp:google"} {
+		if _, err := parseRule(line); err == nil {
+			t.Errorf("line=%s expected error", line)
+		}
+	}
+}
@@ -22,4 +22,32 @@ var (
 		Name:      "max_concurrent_rejects_total",
 		Help:      "Counter of the number of queries rejected because the concurrent queries were at maximum.",
 	})
+
+	hedgeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pforward",
+		Name:      "hedge_requests_total",
+		Help:      "Counter of the number of hedged (backup) requests sent.",
+	})
+
+	hedgeWonCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pforward",
+		Name:      "hedge_wins_total",
+		Help:      "Counter of the number of replies answered by a hedged request.",
+	})
+
+	hedgeSuppressedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pforward",
+		Name:      "hedge_budget_suppressed_total",
+		Help:      "Counter of the number of hedged requests suppressed by the budget.",
+	})
+
+	geoipFallthroughCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pforward",
+		Name:      "geoip_fallthrough_total",
+		Help:      "Counter of the number of replies discarded by geoip and handed to the next stanza.",
+	})
 )
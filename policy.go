@@ -1,37 +1,50 @@
 package pforward
 
 import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/rand"
+	"github.com/coredns/coredns/request"
 )
 
 // Policy defines a policy we use for selecting upstreams.
 type Policy interface {
-	List([]*proxy.Proxy) []*proxy.Proxy
+	List([]Upstream) []Upstream
 	String() string
 }
 
+// RequestPolicy is a Policy that also looks at the request when selecting upstreams.
+type RequestPolicy interface {
+	Policy
+	ListRequest(state request.Request, p []Upstream) []Upstream
+}
+
 // random is a policy that implements random upstream selection.
 type random struct{}
 
 func (r *random) String() string { return "random" }
 
-func (r *random) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *random) List(p []Upstream) []Upstream {
 	switch len(p) {
 	case 1:
 		return p
 	case 2:
 		if rn.Int()%2 == 0 {
-			return []*proxy.Proxy{p[1], p[0]} // swap
+			return []Upstream{p[1], p[0]} // swap
 		}
 		return p
 	}
 
 	perms := rn.Perm(len(p))
-	rnd := make([]*proxy.Proxy, len(p))
+	rnd := make([]Upstream, len(p))
 
 	for i, p1 := range perms {
 		rnd[i] = p[p1]
@@ -46,11 +59,11 @@ type roundRobin struct {
 
 func (r *roundRobin) String() string { return "round_robin" }
 
-func (r *roundRobin) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *roundRobin) List(p []Upstream) []Upstream {
 	poolLen := uint32(len(p))
 	i := atomic.AddUint32(&r.robin, 1) % poolLen
 
-	robin := []*proxy.Proxy{p[i]}
+	robin := []Upstream{p[i]}
 	robin = append(robin, p[:i]...)
 	robin = append(robin, p[i+1:]...)
 
@@ -62,8 +75,287 @@ type sequential struct{}
 
 func (r *sequential) String() string { return "sequential" }
 
-func (r *sequential) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *sequential) List(p []Upstream) []Upstream {
 	return p
 }
 
+// observer is implemented by policies that learn from the outcome of every upstream query.
+type observer interface {
+	observe(p Upstream, rtt time.Duration, err error)
+}
+
+const (
+	fastestDecay   = 10 * time.Second // time constant of the EWMA
+	fastestPenalty = time.Second      // cost of a failed query
+	fastestExplore = 5                // percentage of lists that put a random non-fastest upstream first
+)
+
+// fastest is a policy that orders hosts by their peak-EWMA latency. Latency spikes are taken at once and
+// decay over fastestDecay. Unmeasured hosts come first, and some lists explore a slower host so it gets
+// re-measured.
+type fastest struct {
+	mu    sync.Mutex
+	costs map[string]*peakEWMA // by address, so replaced upstreams don't pile up
+}
+
+type peakEWMA struct {
+	cost  float64 // nanoseconds
+	stamp time.Time
+}
+
+func (e *peakEWMA) observe(rtt time.Duration, now time.Time) {
+	sample := float64(rtt)
+	switch {
+	case e.stamp.IsZero(), sample > e.cost:
+		e.cost = sample
+	default:
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(fastestDecay))
+		e.cost = e.cost*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+func (r *fastest) String() string { return "fastest" }
+
+func (r *fastest) List(p []Upstream) []Upstream {
+	if len(p) == 1 {
+		return p
+	}
+
+	list := r.sorted(p)
+	if rn.Int()%100 < fastestExplore {
+		i := 1 + rn.Int()%(len(list)-1)
+		list[0], list[i] = list[i], list[0]
+	}
+	return list
+}
+
+// sorted returns a copy of p ordered by cost.
+func (r *fastest) sorted(p []Upstream) []Upstream {
+	costs := make(map[Upstream]float64, len(p))
+	r.mu.Lock()
+	for _, host := range p {
+		if e := r.costs[host.Addr()]; e != nil {
+			costs[host] = e.cost
+		}
+	}
+	r.mu.Unlock()
+
+	list := make([]Upstream, len(p))
+	copy(list, p)
+	sort.SliceStable(list, func(i, j int) bool { return costs[list[i]] < costs[list[j]] })
+	return list
+}
+
+func (r *fastest) observe(p Upstream, rtt time.Duration, err error) {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if rtt < fastestPenalty {
+			rtt = fastestPenalty
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.costs == nil {
+		r.costs = make(map[string]*peakEWMA)
+	}
+	e := r.costs[p.Addr()]
+	if e == nil {
+		e = new(peakEWMA)
+		r.costs[p.Addr()] = e
+	}
+	e.observe(rtt, time.Now())
+}
+
+// weightedRoundRobin is a policy that selects hosts by smooth weighted round robin, as nginx does. Hosts
+// that are down are skipped and their share is spread over the others by weight.
+type weightedRoundRobin struct {
+	weights  map[Upstream]int // missing hosts weigh 1
+	maxfails uint32
+
+	mu      sync.Mutex
+	current map[Upstream]int
+}
+
+func (r *weightedRoundRobin) String() string { return "weighted_round_robin" }
+
+func (r *weightedRoundRobin) weight(p Upstream) int {
+	if w, ok := r.weights[p]; ok {
+		return w
+	}
+	return 1
+}
+
+func (r *weightedRoundRobin) List(p []Upstream) []Upstream {
+	if len(p) == 1 {
+		return p
+	}
+
+	r.mu.Lock()
+	if r.current == nil {
+		r.current = make(map[Upstream]int)
+	}
+	best, total := -1, 0
+	for i, host := range p {
+		if host.Down(r.maxfails) {
+			// a host coming back starts from scratch rather than bursting on the credit it had
+			delete(r.current, host)
+			continue
+		}
+		w := r.weight(host)
+		r.current[host] += w
+		total += w
+		if best < 0 || r.current[host] > r.current[p[best]] {
+			best = i
+		}
+	}
+	if best < 0 {
+		// everything is down, ServeDNS falls back to a random host anyway
+		r.mu.Unlock()
+		return p
+	}
+	r.current[p[best]] -= total
+	r.mu.Unlock()
+
+	list := make([]Upstream, 0, len(p))
+	list = append(list, p[best])
+	list = append(list, p[:best]...)
+	list = append(list, p[best+1:]...)
+	return list
+}
+
+// tracker is implemented by policies that count the in-flight queries of every upstream.
+type tracker interface {
+	acquire(p Upstream)
+	release(p Upstream)
+}
+
+// leastOutstanding is a policy that picks the host with fewer in-flight queries out of two random ones
+// (power of two choices), the other hosts follow in their configured order.
+type leastOutstanding struct {
+	inflight sync.Map // Upstream -> *int64
+}
+
+func (r *leastOutstanding) String() string { return "least_outstanding" }
+
+func (r *leastOutstanding) List(p []Upstream) []Upstream {
+	if len(p) == 1 {
+		return p
+	}
+
+	i := rn.Int() % len(p)
+	j := rn.Int() % (len(p) - 1)
+	if j >= i {
+		j++
+	}
+	if atomic.LoadInt64(r.counter(p[j])) < atomic.LoadInt64(r.counter(p[i])) {
+		i = j
+	}
+
+	list := make([]Upstream, 0, len(p))
+	list = append(list, p[i])
+	list = append(list, p[:i]...)
+	list = append(list, p[i+1:]...)
+	return list
+}
+
+func (r *leastOutstanding) counter(p Upstream) *int64 {
+	if c, ok := r.inflight.Load(p); ok {
+		return c.(*int64)
+	}
+	c, _ := r.inflight.LoadOrStore(p, new(int64))
+	return c.(*int64)
+}
+
+func (r *leastOutstanding) acquire(p Upstream) { atomic.AddInt64(r.counter(p), 1) }
+
+func (r *leastOutstanding) release(p Upstream) { atomic.AddInt64(r.counter(p), -1) }
+
+// hash is a policy that orders hosts by a rendezvous (highest random weight) hash of the query name, so
+// every name sticks to one host and only moves to the next one when that host is down. Without a request
+// the hosts keep their configured order.
+type hash struct{}
+
+func (r *hash) String() string { return "hash" }
+
+func (r *hash) List(p []Upstream) []Upstream {
+	return p
+}
+
+func (r *hash) ListRequest(state request.Request, p []Upstream) []Upstream {
+	if len(p) == 1 {
+		return p
+	}
+
+	return rendezvousList(state.Name(), p) // lowercased and fully qualified
+}
+
+// rendezvousList returns a copy of p ordered by the weight of every host for key.
+func rendezvousList(key string, p []Upstream) []Upstream {
+	scores := make(map[Upstream]uint64, len(p))
+	for _, host := range p {
+		scores[host] = rendezvous(key, host.Addr())
+	}
+
+	list := make([]Upstream, len(p))
+	copy(list, p)
+	sort.SliceStable(list, func(i, j int) bool { return scores[list[i]] > scores[list[j]] })
+	return list
+}
+
+// rendezvous returns the weight of addr for key.
+func rendezvous(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+
+	// FNV alone mixes the trailing bytes poorly, finish with the splitmix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+const (
+	defaultStickyV4 = 24
+	defaultStickyV6 = 56
+)
+
+// stickyClient is a policy that orders hosts by a rendezvous hash of the client source prefix, so every
+// client subnet sees the same host and only moves to the next one when that host is down. Without a
+// request the hosts keep their configured order.
+type stickyClient struct {
+	v4, v6 int // prefix lengths
+}
+
+func (r *stickyClient) String() string { return "sticky_client" }
+
+func (r *stickyClient) List(p []Upstream) []Upstream {
+	return p
+}
+
+func (r *stickyClient) ListRequest(state request.Request, p []Upstream) []Upstream {
+	if len(p) == 1 {
+		return p
+	}
+
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return p
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4.Mask(net.CIDRMask(r.v4, 32))
+	} else {
+		ip = ip.Mask(net.CIDRMask(r.v6, 128))
+	}
+	return rendezvousList(ip.String(), p)
+}
+
 var rn = rand.New(time.Now().UnixNano())
@@ -0,0 +1,375 @@
+package pforward
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func newTestProxies(n int) []Upstream {
+	proxies := make([]Upstream, n)
+	for i := range proxies {
+		proxies[i] = proxy.NewProxy("TestPolicy", "127.0.0.1:"+strconv.Itoa(1053+i), transport.DNS)
+	}
+	return proxies
+}
+
+func TestPolicyParse(t *testing.T) {
+	for _, policy := range []string{"random", "round_robin", "sequential", "fastest", "least_outstanding", "weighted_round_robin", "hash", "sticky_client"} {
+		c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\npolicy "+policy+"\n}")
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("policy=%s unexpected error: %v", policy, err)
+		}
+		if got := fs[0].p.String(); got != policy {
+			t.Errorf("expected policy %s, got %s", policy, got)
+		}
+	}
+}
+
+func TestFastest(t *testing.T) {
+	proxies := newTestProxies(3)
+	r := &fastest{}
+
+	// unmeasured upstreams come first
+	r.observe(proxies[0], 10*time.Millisecond, nil)
+	r.observe(proxies[1], 40*time.Millisecond, nil)
+	if list := r.sorted(proxies); list[0] != proxies[2] {
+		t.Errorf("expected unmeasured upstream first, got %s", list[0].Addr())
+	}
+
+	r.observe(proxies[2], 300*time.Millisecond, nil)
+	firsts := map[Upstream]int{}
+	for i := 0; i < 2000; i++ {
+		firsts[r.List(proxies)[0]]++
+	}
+	if firsts[proxies[0]] < 1800 {
+		t.Errorf("expected fastest upstream first most of the time, got %d/2000", firsts[proxies[0]])
+	}
+	if firsts[proxies[1]] == 0 || firsts[proxies[2]] == 0 {
+		t.Errorf("expected slower upstreams to be explored, got %v", firsts)
+	}
+
+	// peaks are taken at once
+	r.observe(proxies[0], 500*time.Millisecond, nil)
+	if list := r.sorted(proxies); list[0] != proxies[1] {
+		t.Errorf("expected latency spike to demote upstream, got %s first", list[0].Addr())
+	}
+
+	// failures are penalized
+	r.observe(proxies[1], time.Millisecond, errors.New("timeout"))
+	if list := r.sorted(proxies); list[2] != proxies[1] {
+		t.Errorf("expected failing upstream last, got %s last", list[2].Addr())
+	}
+
+	// an upstream replacing another one of the same address, like after re-resolving a hostname, takes over
+	// its cost instead of adding an entry
+	replaced := proxy.NewProxy("TestPolicy", proxies[1].Addr(), transport.DNS)
+	r.observe(replaced, time.Millisecond, errors.New("timeout"))
+	if n := len(r.costs); n != len(proxies) {
+		t.Errorf("expected %d costs, got %d", len(proxies), n)
+	}
+	if list := r.sorted([]Upstream{proxies[0], replaced, proxies[2]}); list[2] != replaced {
+		t.Errorf("expected the replacement to keep the cost, got %s last", list[2].Addr())
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	e := new(peakEWMA)
+	now := time.Now()
+	e.observe(100*time.Millisecond, now)
+	e.observe(10*time.Millisecond, now.Add(fastestDecay))
+	// one time constant later the old cost weighs 1/e
+	if cost := time.Duration(e.cost); cost < 40*time.Millisecond || cost > 45*time.Millisecond {
+		t.Errorf("expected cost ~43ms, got %s", cost)
+	}
+	e.observe(time.Second, now.Add(fastestDecay+time.Millisecond))
+	if cost := time.Duration(e.cost); cost != time.Second {
+		t.Errorf("expected peak cost 1s, got %s", cost)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	proxies := newTestProxies(3)
+	r := &leastOutstanding{}
+
+	for i := 0; i < 3; i++ {
+		r.acquire(proxies[0])
+	}
+	r.acquire(proxies[1])
+
+	firsts := map[Upstream]int{}
+	for i := 0; i < 1000; i++ {
+		list := r.List(proxies)
+		if len(list) != len(proxies) {
+			t.Fatalf("expected %d proxies, got %d", len(proxies), len(list))
+		}
+		firsts[list[0]]++
+	}
+	if firsts[proxies[0]] != 0 {
+		t.Errorf("expected the most loaded upstream never to be picked first, got %d/1000", firsts[proxies[0]])
+	}
+	if firsts[proxies[2]] <= firsts[proxies[1]] {
+		t.Errorf("expected the idle upstream to be picked most, got %v", firsts)
+	}
+
+	// with two upstreams the less loaded always wins, the other one is the fallback
+	two := proxies[:2]
+	for i := 0; i < 100; i++ {
+		if list := r.List(two); list[0] != proxies[1] || list[1] != proxies[0] {
+			t.Fatalf("expected %s then %s", proxies[1].Addr(), proxies[0].Addr())
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		r.release(proxies[0])
+	}
+	r.release(proxies[1])
+	if n := *r.counter(proxies[0]); n != 0 {
+		t.Errorf("expected no in-flight queries, got %d", n)
+	}
+}
+
+func TestLeastOutstandingConnect(t *testing.T) {
+	s := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+
+	c := caddy.NewTestController("dns", "pforward . "+s+" {\npolicy least_outstanding\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.connect(context.TODO(), f.proxies[0], request.Request{W: &test.ResponseWriter{}, Req: m}, f.opts, false); err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %v", err)
+	}
+	if n := *f.p.(*leastOutstanding).counter(f.proxies[0]); n != 0 {
+		t.Errorf("expected in-flight query to be released, got %d", n)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	proxies := newTestProxies(3)
+	r := &weightedRoundRobin{weights: map[Upstream]int{proxies[0]: 5}}
+
+	// smooth: the heavy upstream is interleaved with the others
+	expected := []int{0, 0, 1, 0, 2, 0, 0}
+	for round := 0; round < 3; round++ {
+		for i, e := range expected {
+			if list := r.List(proxies); list[0] != proxies[e] {
+				t.Fatalf("round=%d pick=%d expected %s, got %s", round, i, proxies[e].Addr(), list[0].Addr())
+			}
+		}
+	}
+}
+
+func TestWeightedRoundRobinDown(t *testing.T) {
+	proxies := newTestProxies(3)
+	r := &weightedRoundRobin{weights: map[Upstream]int{proxies[0]: 8, proxies[1]: 1, proxies[2]: 1}, maxfails: 1}
+
+	// 127.0.0.1:1053 is not listening, failed health checks take it down
+	proxies[0].(*proxy.Proxy).GetHealthchecker().SetReadTimeout(10 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !proxies[0].Down(r.maxfails) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected upstream to go down")
+		}
+		proxies[0].Healthcheck()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	firsts := map[Upstream]int{}
+	for i := 0; i < 100; i++ {
+		firsts[r.List(proxies)[0]]++
+	}
+	if firsts[proxies[0]] != 0 || firsts[proxies[1]] != 50 || firsts[proxies[2]] != 50 {
+		t.Errorf("expected the down upstream share to be spread evenly, got %v", firsts)
+	}
+}
+
+// downUpstream is an upstream whose health the test sets.
+type downUpstream struct {
+	Upstream
+	down bool
+}
+
+func (p *downUpstream) Down(uint32) bool { return p.down }
+
+func TestWeightedRoundRobinRecover(t *testing.T) {
+	proxies := newTestProxies(3)
+	heavy := &downUpstream{Upstream: proxies[0]}
+	proxies[0] = heavy
+	r := &weightedRoundRobin{weights: map[Upstream]int{heavy: 5}, maxfails: 1}
+
+	// the heavy upstream goes down with credit left
+	for i := 0; i < 5; i++ {
+		r.List(proxies)
+	}
+	heavy.down = true
+	for i := 0; i < 5; i++ {
+		r.List(proxies)
+	}
+	if _, ok := r.current[heavy]; ok {
+		t.Errorf("expected the credit of the down upstream to be reset, got %d", r.current[heavy])
+	}
+
+	// back up it gets its share, at most 3 in a row with weights 5:1:1, without a burst
+	heavy.down = false
+	run, longest := 0, 0
+	for i := 0; i < 14; i++ {
+		if r.List(proxies)[0] == heavy {
+			run++
+		} else {
+			run = 0
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	if longest > 3 {
+		t.Errorf("expected no burst after recovery, got %d picks in a row", longest)
+	}
+}
+
+func TestWeightParse(t *testing.T) {
+	c := caddy.NewTestController("dns", "pforward . 127.0.0.1^4 127.0.0.2 tls://127.0.0.3 {\npolicy weighted_round_robin\nweight tls://127.0.0.3 2\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	wrr := fs[0].p.(*weightedRoundRobin)
+	for i, expected := range []int{4, 1, 2} {
+		if w := wrr.weight(fs[0].proxies[i]); w != expected {
+			t.Errorf("upstream=%s expected weight %d, got %d", fs[0].proxies[i].Addr(), expected, w)
+		}
+	}
+
+	for _, input := range []string{
+		"pforward . 127.0.0.1^4 127.0.0.2",
+		"pforward . 127.0.0.1^0 127.0.0.2 {\npolicy weighted_round_robin\n}",
+		"pforward . 127.0.0.1 {\npolicy weighted_round_robin\nweight 127.0.0.2 2\n}",
+		"pforward . 127.0.0.1 {\npolicy weighted_round_robin\nweight 127.0.0.1 x\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("input=%q expected error", input)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	proxies := newTestProxies(4)
+	r := &hash{}
+	state := func(name string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return request.Request{W: &test.ResponseWriter{}, Req: m}
+	}
+
+	if list := r.ListRequest(state("Example.ORG."), proxies); list[0] != r.ListRequest(state("example.org."), proxies)[0] {
+		t.Error("expected query name to be normalized")
+	}
+
+	firsts := map[Upstream]int{}
+	owner := map[string]Upstream{}
+	for i := 0; i < 1000; i++ {
+		name := "name" + strconv.Itoa(i) + ".example.org."
+		list := r.ListRequest(state(name), proxies)
+		if len(list) != len(proxies) {
+			t.Fatalf("expected %d proxies, got %d", len(proxies), len(list))
+		}
+		if again := r.ListRequest(state(name), proxies); again[0] != list[0] {
+			t.Fatalf("name=%s expected to stick to %s, got %s", name, list[0].Addr(), again[0].Addr())
+		}
+		owner[name] = list[0]
+		firsts[list[0]]++
+	}
+	for _, p := range proxies {
+		if firsts[p] < 150 || firsts[p] > 350 {
+			t.Errorf("expected names to spread over upstreams, got %v", firsts)
+			break
+		}
+	}
+
+	// losing an upstream only moves the names it owned
+	rest := proxies[1:]
+	for name, p := range owner {
+		first := r.ListRequest(state(name), rest)[0]
+		if p != proxies[0] && first != p {
+			t.Fatalf("name=%s expected to stay on %s, moved to %s", name, p.Addr(), first.Addr())
+		}
+		if p == proxies[0] && first != r.ListRequest(state(name), proxies)[1] {
+			t.Fatalf("name=%s expected to move to its second choice", name)
+		}
+	}
+}
+
+func TestStickyClient(t *testing.T) {
+	proxies := newTestProxies(4)
+	r := &stickyClient{v4: defaultStickyV4, v6: defaultStickyV6}
+	state := func(ip string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		return request.Request{W: &test.ResponseWriter{RemoteIP: ip}, Req: m}
+	}
+
+	for _, pair := range [][2]string{{"10.0.0.1", "10.0.0.254"}, {"2001:db8::1", "2001:db8:0:ff::1"}} {
+		if r.ListRequest(state(pair[0]), proxies)[0] != r.ListRequest(state(pair[1]), proxies)[0] {
+			t.Errorf("expected %s and %s to share an upstream", pair[0], pair[1])
+		}
+	}
+
+	firsts := map[Upstream]int{}
+	for i := 0; i < 256; i++ {
+		firsts[r.ListRequest(state("10.0."+strconv.Itoa(i)+".1"), proxies)[0]]++
+	}
+	if len(firsts) != len(proxies) {
+		t.Errorf("expected subnets to spread over upstreams, got %v", firsts)
+	}
+}
+
+func TestStickyClientParse(t *testing.T) {
+	tests := []struct {
+		input  string
+		v4, v6 int
+	}{
+		{"policy sticky_client", defaultStickyV4, defaultStickyV6},
+		{"policy sticky_client /16", 16, defaultStickyV6},
+		{"policy sticky_client /32 /64", 32, 64},
+	}
+	for _, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\n"+tc.input+"\n}")
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("input=%q unexpected error: %v", tc.input, err)
+		}
+		if r := fs[0].p.(*stickyClient); r.v4 != tc.v4 || r.v6 != tc.v6 {
+			t.Errorf("input=%q expected /%d /%d, got /%d /%d", tc.input, tc.v4, tc.v6, r.v4, r.v6)
+		}
+	}
+
+	for _, input := range []string{"policy sticky_client 24", "policy sticky_client /33", "policy sticky_client /24 /129", "policy sticky_client /24 /56 /1"} {
+		c := caddy.NewTestController("dns", "pforward . 127.0.0.1 {\n"+input+"\n}")
+		if _, err := parseForward(c); err == nil {
+			t.Errorf("input=%q expected error", input)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package pforward
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/coredns/caddy"
@@ -68,3 +69,35 @@ func TestProxyTLSFail(t *testing.T) {
 		t.Fatal("Expected *not* to receive reply, but got one")
 	}
 }
+
+// newServer starts a udp/tcp test server on loopback and returns its address. Unlike dnstest.NewServer the handler is not
+// registered on the global mux, so several servers with different behaviour can run side by side.
+func newServer(t *testing.T, f dns.HandlerFunc) string {
+	t.Helper()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		t.Fatal(err)
+	}
+
+	s1 := &dns.Server{PacketConn: udp, Handler: f}
+	s2 := &dns.Server{Listener: tcp, Handler: f}
+	started := make(chan struct{}, 2)
+	s1.NotifyStartedFunc = func() { started <- struct{}{} }
+	s2.NotifyStartedFunc = func() { started <- struct{}{} }
+	go s1.ActivateAndServe()
+	go s2.ActivateAndServe()
+	<-started
+	<-started
+
+	t.Cleanup(func() {
+		s1.Shutdown()
+		s2.Shutdown()
+	})
+	return tcp.Addr().String()
+}
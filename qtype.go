@@ -0,0 +1,108 @@
+package pforward
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// qtypeSet is the set of query types a stanza applies to, either the listed types or, when exclude is set,
+// all but the listed types. With nodata the other types of the matched names are answered with NODATA
+// instead of going to the next plugin.
+type qtypeSet struct {
+	types   map[uint16]bool
+	exclude bool
+	nodata  bool
+}
+
+// parseQtypes parses the arguments of qtype: type names, all negated with "!" or none of them, and an
+// optional trailing "nodata".
+func parseQtypes(args []string) (*qtypeSet, error) {
+	q := &qtypeSet{types: make(map[uint16]bool, len(args))}
+	if n := len(args) - 1; strings.EqualFold(args[n], "nodata") {
+		if n == 0 {
+			return nil, fmt.Errorf("qtype nodata requires types")
+		}
+		args, q.nodata = args[:n], true
+	}
+	for i, arg := range args {
+		exclude := strings.HasPrefix(arg, "!")
+		if i > 0 && exclude != q.exclude {
+			return nil, fmt.Errorf("qtype can't mix included and excluded types: %s", strings.Join(args, " "))
+		}
+		q.exclude = exclude
+
+		qtype, err := parseQtype(strings.TrimPrefix(arg, "!"))
+		if err != nil {
+			return nil, err
+		}
+		q.types[qtype] = true
+	}
+	return q, nil
+}
+
+// parseQtype parses a type name like AAAA, or the generic TYPEnnn form of RFC 3597.
+func parseQtype(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if qtype, ok := dns.StringToType[s]; ok {
+		return qtype, nil
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		if qtype, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return uint16(qtype), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown qtype '%s'", s)
+}
+
+// merge adds the types of o, both have to include or both have to exclude.
+func (q *qtypeSet) merge(o *qtypeSet) error {
+	if q.exclude != o.exclude {
+		return fmt.Errorf("qtype can't mix included and excluded types")
+	}
+	for qtype := range o.types {
+		q.types[qtype] = true
+	}
+	q.nodata = q.nodata || o.nodata
+	return nil
+}
+
+// Match reports whether qtype is in the set, a nil set matches every type.
+func (q *qtypeSet) Match(qtype uint16) bool {
+	if q == nil {
+		return true
+	}
+	return q.types[qtype] != q.exclude
+}
+
+// Nodata reports whether the types outside the set are answered with NODATA.
+func (q *qtypeSet) Nodata() bool { return q != nil && q.nodata }
+
+// Format returns the type names of q in order, prefixed by "!" when they are excluded.
+func (q *qtypeSet) Format() []string {
+	if q == nil {
+		return nil
+	}
+
+	qtypes := make([]uint16, 0, len(q.types))
+	for qtype := range q.types {
+		qtypes = append(qtypes, qtype)
+	}
+	sort.Slice(qtypes, func(i, j int) bool { return qtypes[i] < qtypes[j] })
+
+	results := make([]string, 0, len(qtypes))
+	for _, qtype := range qtypes {
+		name := dns.Type(qtype).String()
+		if q.exclude {
+			name = "!" + name
+		}
+		results = append(results, name)
+	}
+	if q.nodata {
+		results = append(results, "nodata")
+	}
+	return results
+}
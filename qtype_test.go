@@ -0,0 +1,135 @@
+package pforward
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeMatch(t *testing.T) {
+	foreign := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 1.1.1.1"))
+		w.WriteMsg(ret)
+	})
+	local := newServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 10.0.0.1"))
+		w.WriteMsg(ret)
+	})
+
+	tests := []struct {
+		qtypes   string
+		qtype    uint16
+		expected string
+	}{
+		{"A AAAA HTTPS", dns.TypeA, "1.1.1.1"},
+		{"A AAAA HTTPS", dns.TypeHTTPS, "1.1.1.1"},
+		{"A AAAA HTTPS", dns.TypeTXT, "10.0.0.1"},
+		{"a\nqtype mx", dns.TypeMX, "1.1.1.1"},
+		{"!PTR", dns.TypeA, "1.1.1.1"},
+		{"!PTR", dns.TypePTR, "10.0.0.1"},
+		{"!PTR !AAAA", dns.TypeAAAA, "10.0.0.1"},
+		{"TYPE65", dns.TypeHTTPS, "1.1.1.1"},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward . "+foreign+" {\nqtype "+tc.qtypes+"\n}\npforward . "+local)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		fs[0].Next = fs[1]
+		for _, f := range fs {
+			f.OnStartup()
+			defer f.OnShutdown()
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := fs[0].ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but didn't: %v", i, err)
+		}
+		if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, ip)
+		}
+	}
+}
+
+func TestQtypeNodata(t *testing.T) {
+	upstream := newHedgeServer(t, 0, "1.1.1.1")
+	c := caddy.NewTestController("dns", "pforward example.org "+upstream+" {\nqtype !AAAA nodata\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.Next = test.ErrorHandler()
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers int
+		rcode   int
+	}{
+		{"www.example.org.", dns.TypeA, 1, dns.RcodeSuccess},
+		{"www.example.org.", dns.TypeAAAA, 0, dns.RcodeSuccess},
+		{"example.com.", dns.TypeAAAA, 0, dns.RcodeServerFailure}, // not ours, to the next plugin
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but didn't: %v", i, err)
+		}
+		if rec.Msg.Rcode != tc.rcode || len(rec.Msg.Answer) != tc.answers {
+			t.Errorf("Test %d: expected rcode %s with %d answers, got %v", i, dns.RcodeToString[tc.rcode], tc.answers, rec.Msg)
+		}
+	}
+}
+
+func TestQtypeParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []string
+	}{
+		{"pforward . 127.0.0.1 {\nqtype A AAAA HTTPS\n}", false, []string{"A", "AAAA", "HTTPS"}},
+		{"pforward . 127.0.0.1 {\nqtype !PTR\nqtype !aaaa\n}", false, []string{"!PTR", "!AAAA"}},
+		{"pforward . 127.0.0.1 {\nqtype TYPE65534\n}", false, []string{"TYPE65534"}},
+		{"pforward . 127.0.0.1", false, nil},
+		{"pforward . 127.0.0.1 {\nqtype\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype A !PTR\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype A\nqtype !PTR\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype NOPE\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype TYPE65536\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype !AAAA nodata\n}", false, []string{"!AAAA", "nodata"}},
+		{"pforward . 127.0.0.1 {\nqtype A\nqtype MX NODATA\n}", false, []string{"A", "MX", "nodata"}},
+		{"pforward . 127.0.0.1 {\nqtype nodata\n}", true, nil},
+		{"pforward . 127.0.0.1 {\nqtype nodata A\n}", true, nil},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Fatalf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if qtypes := fs[0].qtypes.Format(); !reflect.DeepEqual(qtypes, test.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, qtypes)
+		}
+	}
+}
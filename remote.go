@@ -0,0 +1,347 @@
+package pforward
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	defaultRemoteReload = time.Hour
+	remoteTimeout       = 30 * time.Second
+	maxRemoteSize       = 64 << 20 // community lists are a few MB
+)
+
+// isRemote reports whether path is a ruleset URL.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteRuleset fetches a ruleset over HTTP(S). Refreshes are conditional on the ETag and Last-Modified of
+// the last good copy, which is kept in cacheDir, when set, so a restart without network still has rules.
+// Fetched copies are verified before they replace the last good one. A cached copy is served at startup
+// without waiting for the network, the watcher fetches the current one when it starts.
+type remoteRuleset struct {
+	url      string
+	format   rulesetFormat
+	cacheDir string // "": no cache
+	verifier verifier
+	client   *http.Client
+
+	// the last good copy, only used by read which the watcher serializes
+	data         []byte
+	proof        []byte // what data was verified against, nil: nothing fetched
+	etag         string
+	lastModified string
+	stale        bool // data is the cached copy and was not revalidated yet
+}
+
+// remoteMeta is stored next to the cached copy.
+type remoteMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func newRemoteRuleset(url string) *remoteRuleset {
+	return &remoteRuleset{url: url, client: &http.Client{Timeout: remoteTimeout}}
+}
+
+// read is the read function of the rulesetWatcher of the remote ruleset. The first read serves the cached
+// copy when there is one, later reads fetch and fall back to the last good copy when that fails.
+func (r *remoteRuleset) read(_ string, files rulesetFiles) ([]Rule, error) {
+	var data []byte
+	if r.data == nil && r.loadCache() {
+		r.stale = true
+		data = r.data
+	} else {
+		var err error
+		r.stale = false
+		if data, err = r.fetch(); err != nil {
+			if r.data == nil {
+				return nil, fmt.Errorf("unable to fetch '%s' '%v'", r.url, err)
+			}
+			log.Warningf("Failed to fetch ruleset '%s', using the last good copy: %v", r.url, err)
+			data = r.data
+		}
+	}
+	files[r.url] = sha256.Sum256(data)
+
+	rules, err := parseRuleset(data, r.url, r.format, nil)
+	if len(rules) == 0 || err != nil {
+		return nil, fmt.Errorf("unable to normalize '%s' '%v'", r.url, err)
+	}
+	return rules, nil
+}
+
+// fetch returns the current ruleset, the last good copy when it is not modified.
+func (r *remoteRuleset) fetch() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.data != nil {
+		if r.etag != "" {
+			req.Header.Set("If-None-Match", r.etag)
+		}
+		if r.lastModified != "" {
+			req.Header.Set("If-Modified-Since", r.lastModified)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && r.data != nil:
+		return r.data, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := readAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var proof []byte
+	if r.verifier != nil {
+		if proof, err = r.verifier.proof(r); err != nil {
+			return nil, err
+		}
+		if err := r.verifier.check(r, proof, data); err != nil {
+			return nil, err
+		}
+	}
+
+	r.data, r.proof, r.etag, r.lastModified = data, proof, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	r.storeCache()
+	return data, nil
+}
+
+// get fetches a file next to the ruleset, like its signature.
+func (r *remoteRuleset) get(url string) ([]byte, error) {
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return readAll(resp.Body)
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxRemoteSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteSize {
+		return nil, fmt.Errorf("ruleset larger than %d bytes", maxRemoteSize)
+	}
+	return data, nil
+}
+
+// cachePath returns the path of the cached copy, the metadata and the proof of the verifier are stored with
+// the extra extensions ".meta" and ".proof".
+func (r *remoteRuleset) cachePath() string {
+	sum := sha256.Sum256([]byte(r.url))
+	return filepath.Join(r.cacheDir, hex.EncodeToString(sum[:8])+".rules")
+}
+
+// isStale reports whether the last read served the cached copy without fetching.
+func (r *remoteRuleset) isStale() bool { return r.stale }
+
+// loadCache loads the cached copy, it returns false when there is none or it fails verification.
+func (r *remoteRuleset) loadCache() bool {
+	if r.cacheDir == "" {
+		return false
+	}
+	path := r.cachePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	proof, _ := os.ReadFile(path + ".proof")
+	if r.verifier != nil {
+		if err := r.verifier.check(r, proof, data); err != nil {
+			log.Warningf("Ignoring cached ruleset '%s': %v", r.url, err)
+			return false
+		}
+	}
+	var meta remoteMeta
+	if raw, err := os.ReadFile(path + ".meta"); err == nil {
+		json.Unmarshal(raw, &meta)
+	}
+	if meta.URL != r.url {
+		meta = remoteMeta{}
+	}
+	r.data, r.proof, r.etag, r.lastModified = data, proof, meta.ETag, meta.LastModified
+	return true
+}
+
+func (r *remoteRuleset) storeCache() {
+	if r.cacheDir == "" {
+		return
+	}
+	path := r.cachePath()
+	meta, _ := json.Marshal(remoteMeta{URL: r.url, ETag: r.etag, LastModified: r.lastModified})
+	if err := writeFileAtomic(path, r.data); err != nil {
+		log.Warningf("Failed to cache ruleset '%s': %v", r.url, err)
+		return
+	}
+	if err := writeFileAtomic(path+".meta", meta); err != nil {
+		log.Warningf("Failed to cache ruleset '%s': %v", r.url, err)
+	}
+	if r.proof == nil {
+		os.Remove(path + ".proof")
+	} else if err := writeFileAtomic(path+".proof", r.proof); err != nil {
+		log.Warningf("Failed to cache ruleset '%s': %v", r.url, err)
+	}
+}
+
+// writeFileAtomic replaces path with data, readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// verifier checks a ruleset before it is used. The proof, like a signature, is fetched with every copy and
+// cached with it, so the cached copy is checked again when it is loaded.
+type verifier interface {
+	// proof fetches what the ruleset is checked against, nil when there is nothing to fetch.
+	proof(r *remoteRuleset) ([]byte, error)
+	// check checks data against proof without touching the network.
+	check(r *remoteRuleset, proof, data []byte) error
+}
+
+// sha256Verifier checks the SHA-256 of the ruleset against sum, or when sum is nil against the sha256sum
+// style file at the ruleset URL plus ".sha256".
+type sha256Verifier struct {
+	sum []byte
+}
+
+func (v *sha256Verifier) proof(r *remoteRuleset) ([]byte, error) {
+	if v.sum != nil {
+		return nil, nil
+	}
+	return r.get(r.url + ".sha256")
+}
+
+func (v *sha256Verifier) check(r *remoteRuleset, proof, data []byte) error {
+	want := v.sum
+	if want == nil {
+		fields := strings.Fields(string(proof))
+		if len(fields) == 0 {
+			return fmt.Errorf("empty checksum file %s.sha256", r.url)
+		}
+		var err error
+		if want, err = hex.DecodeString(fields[0]); err != nil {
+			return fmt.Errorf("invalid checksum file %s.sha256: %v", r.url, err)
+		}
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("sha256 mismatch of %s, got %x", r.url, sum)
+	}
+	return nil
+}
+
+// minisignVerifier checks the minisign signature at the ruleset URL plus ".minisig".
+type minisignVerifier struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// parseMinisignKey parses a minisign public key, the base64 line of minisign.pub.
+func parseMinisignKey(s string) (*minisignVerifier, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid minisign public key '%s'", s)
+	}
+	v := &minisignVerifier{key: ed25519.PublicKey(raw[10:])}
+	copy(v.keyID[:], raw[2:10])
+	return v, nil
+}
+
+func (v *minisignVerifier) proof(r *remoteRuleset) ([]byte, error) {
+	return r.get(r.url + ".minisig")
+}
+
+func (v *minisignVerifier) check(r *remoteRuleset, proof, data []byte) error {
+	if err := v.checkSignature(proof, data); err != nil {
+		return fmt.Errorf("minisign %s.minisig: %v", r.url, err)
+	}
+	return nil
+}
+
+var errBadSignature = errors.New("invalid signature")
+
+// checkSignature verifies the signature file sigFile of data: the signature, of the BLAKE2b-512 hash of
+// data for the prehashed "ED" algorithm, and the global signature over it and the trusted comment.
+func (v *minisignVerifier) checkSignature(sigFile, data []byte) error {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(sigFile))
+	for sc.Scan() && len(lines) < 4 {
+		lines = append(lines, strings.TrimRight(sc.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed signature file")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+	if !bytes.Equal(sig[2:10], v.keyID[:]) {
+		return fmt.Errorf("signed with key %X, expected %X", sig[2:10], v.keyID)
+	}
+	switch string(sig[:2]) {
+	case "ED":
+		sum := blake2b.Sum512(data)
+		data = sum[:]
+	case "Ed":
+	default:
+		return fmt.Errorf("unknown signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(v.key, data, sig[10:]) {
+		return errBadSignature
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("malformed global signature")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(v.key, append(sig[10:], trusted...), global) {
+		return errBadSignature
+	}
+	return nil
+}
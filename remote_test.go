@@ -0,0 +1,348 @@
+package pforward
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"golang.org/x/crypto/blake2b"
+)
+
+// rulesServer serves files by path with an ETag, answering conditional requests.
+type rulesServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	files       map[string]string
+	hits        int
+	notModified int
+	hang        <-chan struct{} // non-nil: requests are held until it is closed
+}
+
+func newRulesServer(t *testing.T, files map[string]string) *rulesServer {
+	s := &rulesServer{files: files}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.hits++
+		if hang := s.hang; hang != nil {
+			s.mu.Unlock()
+			<-hang
+			s.mu.Lock()
+		}
+
+		content, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sum := sha256.Sum256([]byte(content))
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rulesServer) set(path, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = content
+}
+
+func (s *rulesServer) stats() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits, s.notModified
+}
+
+func TestRemoteRuleset(t *testing.T) {
+	s := newRulesServer(t, map[string]string{"/rules.txt": "google.com\n"})
+	cache := t.TempDir()
+
+	c := caddy.NewTestController("dns", "pforward "+s.URL+"/rules.txt 127.0.0.1 {\ncache_dir "+cache+"\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	if !f.from.Load().Match("www.google.com.") {
+		t.Fatalf("expected the remote rules, got %v", f.from.Load().Format())
+	}
+	if f.watcher.interval != defaultRemoteReload {
+		t.Errorf("expected reload interval %s, got %s", defaultRemoteReload, f.watcher.interval)
+	}
+
+	// unchanged content is not sent again
+	if changed, err := f.watcher.reload(); changed || err != nil {
+		t.Fatalf("expected unchanged reload to be skipped, changed=%v err=%v", changed, err)
+	}
+	if _, notModified := s.stats(); notModified != 1 {
+		t.Errorf("expected a conditional request, got %d not modified", notModified)
+	}
+
+	s.set("/rules.txt", "server=/youtube.com/114.114.114.114\n")
+	if changed, err := f.watcher.reload(); !changed || err != nil {
+		t.Fatalf("expected changed rules to build, changed=%v err=%v", changed, err)
+	}
+	if from := f.from.Load(); from.Match("google.com.") || !from.Match("www.youtube.com.") {
+		t.Errorf("unexpected rules after reload: %v", from.Format())
+	}
+
+	// a failing refresh keeps the rules
+	s.mu.Lock()
+	delete(s.files, "/rules.txt")
+	s.mu.Unlock()
+	if _, err := f.watcher.reload(); err != nil {
+		t.Errorf("expected the last good copy on fetch errors, got %v", err)
+	}
+	if !f.from.Load().Match("www.youtube.com.") {
+		t.Errorf("expected the rules to stay")
+	}
+
+	// a restart serves the cache and revalidates it once the watcher starts, a cold start without network
+	// uses the cache
+	s.set("/rules.txt", "server=/youtube.com/114.114.114.114\n")
+	hits, _ := s.stats()
+	c = caddy.NewTestController("dns", "pforward "+s.URL+"/rules.txt 127.0.0.1 {\ncache_dir "+cache+"\n}")
+	fs, err = parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if n, _ := s.stats(); n != hits {
+		t.Errorf("expected the cached copy without a fetch at startup, got %d requests", n-hits)
+	}
+	fs[0].OnStartup()
+	for i := 0; i < 100; i++ {
+		if _, notModified := s.stats(); notModified == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fs[0].OnShutdown()
+	if _, notModified := s.stats(); notModified != 2 {
+		t.Errorf("expected the cached copy to be revalidated, got %d not modified", notModified)
+	}
+	s.Close()
+	c = caddy.NewTestController("dns", "pforward "+s.URL+"/rules.txt 127.0.0.1 {\ncache_dir "+cache+"\n}")
+	fs, err = parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to start from the cache: %s", err)
+	}
+	if !fs[0].from.Load().Match("www.youtube.com.") {
+		t.Errorf("expected the cached rules, got %v", fs[0].from.Load().Format())
+	}
+
+	// without a cache there is nothing to fall back to
+	c = caddy.NewTestController("dns", "pforward "+s.URL+"/rules.txt 127.0.0.1")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("expected an error without network and cache")
+	}
+}
+
+func TestRemoteRulesetRefresh(t *testing.T) {
+	s := newRulesServer(t, map[string]string{"/rules.txt": "google.com\n"})
+
+	c := caddy.NewTestController("dns", "pforward "+s.URL+"/rules.txt 127.0.0.1 {\nreload 20ms\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	s.set("/rules.txt", "||youtube.com^\n")
+	for i := 0; i < 100; i++ {
+		if f.from.Load().Match("youtube.com.") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the refreshed rules, got %v", f.from.Load().Format())
+}
+
+func TestRemoteRulesetHang(t *testing.T) {
+	s := newRulesServer(t, map[string]string{"/rules.txt": "google.com\n"})
+	cache := t.TempDir()
+	input := "pforward " + s.URL + "/rules.txt 127.0.0.1 {\ncache_dir " + cache + "\n}"
+	if _, err := parseForward(caddy.NewTestController("dns", input)); err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+
+	// the server accepts requests but never answers
+	release := make(chan struct{})
+	s.mu.Lock()
+	s.hang = release
+	s.mu.Unlock()
+	hits, _ := s.stats()
+
+	start := time.Now()
+	fs, err := parseForward(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Failed to start from the cache: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the cached copy right away, took %s", elapsed)
+	}
+	f := fs[0]
+	if !f.from.Load().Match("www.google.com.") {
+		t.Errorf("expected the cached rules, got %v", f.from.Load().Format())
+	}
+
+	// the watcher does the first fetch
+	f.OnStartup()
+	defer f.OnShutdown()
+	defer close(release)
+	for i := 0; i < 100; i++ {
+		if n, _ := s.stats(); n > hits {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the watcher to fetch the ruleset")
+}
+
+// minisign signs data as minisign -S does, returning the public key and the signature file.
+func minisign(t *testing.T, data []byte, trusted string) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key := append(append([]byte("Ed"), keyID...), pub...)
+
+	sum := blake2b.Sum512(data)
+	sig := append(append([]byte("ED"), keyID...), ed25519.Sign(priv, sum[:])...)
+	global := ed25519.Sign(priv, append(append([]byte(nil), sig[10:]...), trusted...))
+
+	file := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+	return base64.StdEncoding.EncodeToString(key), file
+}
+
+func TestRemoteRulesetVerify(t *testing.T) {
+	rules := "google.com\n"
+	sum := sha256.Sum256([]byte(rules))
+	key, sig := minisign(t, []byte(rules), "timestamp:1700000000\tfile:rules.txt")
+	_, otherSig := minisign(t, []byte(rules), "timestamp:1700000000")
+	_, tamperedSig := minisign(t, []byte("evil.com\n"), "timestamp:1700000000")
+
+	s := newRulesServer(t, map[string]string{
+		"/rules.txt":            rules,
+		"/rules.txt.sha256":     hex.EncodeToString(sum[:]) + "  rules.txt\n",
+		"/rules.txt.minisig":    sig,
+		"/bad.txt":              rules,
+		"/bad.txt.sha256":       hex.EncodeToString(make([]byte, sha256.Size)) + "\n",
+		"/bad.txt.minisig":      otherSig,
+		"/tampered.txt":         rules,
+		"/tampered.txt.minisig": tamperedSig,
+		"/unsigned.txt":         rules,
+	})
+
+	tests := []struct {
+		path      string
+		verify    string
+		shouldErr bool
+	}{
+		{"/rules.txt", "sha256", false},
+		{"/rules.txt", "sha256 " + hex.EncodeToString(sum[:]), false},
+		{"/rules.txt", "minisign " + key, false},
+		{"/bad.txt", "sha256", true},
+		{"/rules.txt", "sha256 " + hex.EncodeToString(make([]byte, sha256.Size)), true},
+		{"/bad.txt", "minisign " + key, true},
+		{"/tampered.txt", "minisign " + key, true},
+		{"/unsigned.txt", "minisign " + key, true},
+		{"/unsigned.txt", "sha256", true},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", "pforward "+s.URL+tc.path+" 127.0.0.1 {\nverify "+tc.verify+"\n}")
+		_, err := parseForward(c)
+		if (err != nil) != tc.shouldErr {
+			t.Errorf("Test %d: expected error %t, got %v", i, tc.shouldErr, err)
+		}
+	}
+}
+
+func TestRemoteRulesetVerifyCache(t *testing.T) {
+	rules := "google.com\n"
+	sum := sha256.Sum256([]byte(rules))
+	key, sig := minisign(t, []byte(rules), "timestamp:1700000000")
+
+	for i, verify := range []string{"sha256 " + hex.EncodeToString(sum[:]), "sha256", "minisign " + key} {
+		s := newRulesServer(t, map[string]string{
+			"/rules.txt":         rules,
+			"/rules.txt.sha256":  hex.EncodeToString(sum[:]) + "\n",
+			"/rules.txt.minisig": sig,
+		})
+		cache := t.TempDir()
+		input := "pforward " + s.URL + "/rules.txt 127.0.0.1 {\ncache_dir " + cache + "\nverify " + verify + "\n}"
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		s.Close()
+
+		// the cached copy is verified again without network
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err != nil {
+			t.Errorf("Test %d: expected the verified cached copy, got %v", i, err)
+		}
+
+		r := newRemoteRuleset(s.URL + "/rules.txt")
+		r.cacheDir = cache
+		if err := os.WriteFile(r.cachePath(), []byte("evil.com\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseForward(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Test %d: expected the tampered cached copy to be skipped", i)
+		}
+	}
+}
+
+func TestRemoteRulesetParse(t *testing.T) {
+	s := newRulesServer(t, map[string]string{"/rules.txt": "google.com\n", "/include.txt": "include:rules.txt\n"})
+	file := t.TempDir() + "/rules"
+	if err := os.WriteFile(file, []byte("google.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nformat plain\nreload 0\n}", false},
+		{"pforward " + s.URL + "/include.txt 127.0.0.1", true},
+		{"pforward " + s.URL + "/missing.txt 127.0.0.1", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\ncache_dir\n}", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nverify\n}", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nverify md5\n}", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nverify sha256 abcd\n}", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nverify minisign\n}", true},
+		{"pforward " + s.URL + "/rules.txt 127.0.0.1 {\nverify minisign notakey\n}", true},
+		{"pforward " + file + " 127.0.0.1 {\ncache_dir " + t.TempDir() + "\n}", true},
+		{"pforward " + file + " 127.0.0.1 {\nverify sha256\n}", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+	}
+}
@@ -2,11 +2,18 @@ package pforward
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -70,19 +77,31 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-// OnStartup starts a goroutines for all proxies.
+// OnStartup starts a goroutines for all proxies and the ruleset and client watchers.
 func (f *PForward) OnStartup() (err error) {
 	for _, p := range f.proxies {
 		p.Start(f.hcInterval)
 	}
+	if f.watcher != nil {
+		f.watcher.start()
+	}
+	if f.clientWatcher != nil {
+		f.clientWatcher.start()
+	}
 	return nil
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies and the ruleset and client watchers.
 func (f *PForward) OnShutdown() error {
 	for _, p := range f.proxies {
 		p.Stop()
 	}
+	if f.watcher != nil {
+		f.watcher.stop()
+	}
+	if f.clientWatcher != nil {
+		f.clientWatcher.stop()
+	}
 	return nil
 }
 
@@ -94,91 +113,204 @@ func parseForward(c *caddy.Controller) ([]*PForward, error) {
 			return nil, err
 		}
 		fs = append(fs, f)
-		log.Infof("Forwarding configured for %+v", Format(f.from.Load()))
+		if f.qtypes != nil {
+			log.Infof("Forwarding configured for %+v qtype=%+v", f.from.Load().Format(), f.qtypes.Format())
+		} else {
+			log.Infof("Forwarding configured for %+v", f.from.Load().Format())
+		}
 	}
 	return fs, nil
 }
 
-func readRuleset(path string) ([]string, error) {
+func readRuleset(path string) ([]Rule, error) {
+	return readRulesetFiles(path, formatAuto, rulesetFiles{})
+}
+
+// readRulesetFiles reads the ruleset at path and its includes, recording every file read in files. A file
+// included twice is only read once. With formatAuto the format of every file is detected on its own.
+func readRulesetFiles(path string, format rulesetFormat, files rulesetFiles) ([]Rule, error) {
+	path = filepath.Clean(path)
+	if _, ok := files[path]; ok {
+		return nil, nil
+	}
 	dirname := filepath.Dir(path)
 
-	f, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("invalid path=%s err=%v", path, err)
 	}
+	files[path] = sha256.Sum256(data)
+
+	return parseRuleset(data, path, format, func(include string) ([]Rule, error) {
+		return readRulesetFiles(filepath.Join(dirname, include), format, files)
+	})
+}
+
+// parseRuleset parses the ruleset data read from name, include reads the rules of an include line of a
+// plain ruleset. A nil include rejects include lines.
+func parseRuleset(data []byte, name string, format rulesetFormat, include func(string) ([]Rule, error)) ([]Rule, error) {
+	fileFormat := format
+	if fileFormat == formatAuto {
+		fileFormat = detectFormat(data)
+	}
+	parse := parseRule
+	switch fileFormat {
+	case formatDnsmasq:
+		parse = parseDnsmasq
+	case formatAdGuard:
+		parse = parseAdGuard
+	case formatHosts:
+		parse = parseHosts
+	}
 
-	zones := make([]string, 0)
-	sc := bufio.NewScanner(f)
+	rules := make([]Rule, 0)
+	sc := bufio.NewScanner(bytes.NewReader(data))
 	for sc.Scan() {
 		line := strings.TrimSpace(sc.Text())
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
 
-		if strings.HasPrefix(line, "include:") {
-			subrules, err := readRuleset(filepath.Join(dirname, strings.TrimSpace(strings.TrimPrefix(line, "include:"))))
+		if fileFormat == formatPlain && strings.HasPrefix(line, "include:") {
+			if include == nil {
+				return nil, fmt.Errorf("include is not supported in %s", name)
+			}
+			subrules, err := include(strings.TrimSpace(strings.TrimPrefix(line, "include:")))
 			if err != nil {
 				return nil, fmt.Errorf("unable to read include file '%s': %v", line, err)
 			}
-			zones = append(zones, subrules...)
+			rules = append(rules, subrules...)
 		} else {
-			zones = append(zones, plugin.Host(line).NormalizeExact()...)
+			subrules, err := parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule '%s' in %s: %v", line, name, err)
+			}
+			rules = append(rules, subrules...)
 		}
 	}
 
-	return zones, nil
+	return rules, nil
+}
+
+// parseRule parses a ruleset line: an optional "!" or "except:" for exclusions, an optional type prefix
+// ("domain:", "full:", "keyword:" or "regexp:") and the value. Invalid domains are skipped, invalid full
+// names and regular expressions are an error.
+func parseRule(line string) ([]Rule, error) {
+	rule := Rule{Type: RuleDomain}
+	if strings.HasPrefix(line, "!") {
+		line, rule.Exclude = strings.TrimSpace(line[1:]), true
+	} else if strings.HasPrefix(line, "except:") {
+		line, rule.Exclude = strings.TrimSpace(strings.TrimPrefix(line, "except:")), true
+	}
+	for typ, prefix := range rulePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			rule.Type, line = typ, strings.TrimSpace(strings.TrimPrefix(line, prefix))
+			break
+		}
+	}
+
+	switch rule.Type {
+	case RuleDomain:
+		zones := plugin.Host(line).NormalizeExact()
+		rules := make([]Rule, 0, len(zones))
+		for _, zone := range zones {
+			rules = append(rules, Rule{Type: RuleDomain, Value: zone, Exclude: rule.Exclude})
+		}
+		return rules, nil
+	case RuleFull:
+		if _, ok := dns.IsDomainName(line); !ok {
+			return nil, fmt.Errorf("invalid domain name '%s'", line)
+		}
+		rule.Value = plugin.Name(line).Normalize()
+	case RuleKeyword:
+		rule.Value = strings.ToLower(line)
+	case RuleRegexp:
+		if _, err := regexp.Compile(line); err != nil {
+			return nil, err
+		}
+		rule.Value = line
+	}
+
+	if rule.Value == "" {
+		return nil, fmt.Errorf("empty %s rule", strings.TrimSuffix(rulePrefixes[rule.Type], ":"))
+	}
+	if rule.Exclude && (rule.Type == RuleKeyword || rule.Type == RuleRegexp) {
+		return nil, fmt.Errorf("exclusion is only supported for domain and full rules")
+	}
+	return []Rule{rule}, nil
 }
 
 func parseFrom(c *caddy.Controller, f *PForward) error {
-	var (
-		from *TrieNode
-		path string
-	)
+	var path string
 	if ok := c.Args(&path); !ok {
 		return c.ArgErr()
 	}
 
+	if isRemote(path) {
+		f.remote = newRemoteRuleset(path)
+		f.watcher = newRulesetWatcher(path, f.storeFrom)
+		f.watcher.read, f.watcher.stale, f.watcher.interval = f.remote.read, f.remote.isStale, defaultRemoteReload
+		return nil
+	}
+
 	info, err := os.Stat(path)
-	if err == nil && !info.IsDir() {
-		zones, err := readRuleset(path)
-		if len(zones) == 0 || err != nil {
-			return fmt.Errorf("unable to normalize '%s' '%v'", path, err)
-		}
+	if (err == nil && !info.IsDir()) || strings.HasPrefix(path, geositePrefix) {
+		f.watcher = newRulesetWatcher(path, f.storeFrom)
+		return nil
+	}
 
-		for _, domain := range zones {
-			from = InsertDomain(domain, from)
-		}
-		f.from.Store(from)
+	rules, err := parseRule(path)
+	if len(rules) == 0 || err != nil {
+		return fmt.Errorf("unable to normalize '%s' '%v'", path, err)
+	}
+	f.rules = rules
 
-		go func() {
-			ticker := time.NewTicker(time.Minute)
-			for range ticker.C {
-				zones, err := readRuleset(path)
-				if len(zones) == 0 || err != nil {
-					log.Errorf("update domains err=%v", err)
-					continue
-				}
+	return nil
+}
 
-				for _, domain := range zones {
-					from = InsertDomain(domain, from)
-				}
-				f.from.Store(from)
-				log.Infof("update domains=%s", Format(f.from.Load()))
-			}
-		}()
+// loadFrom loads the ruleset file, or the inline FROM, into a fresh matcher.
+func (f *PForward) loadFrom() error {
+	if f.watcher != nil {
+		_, err := f.watcher.reload()
+		return err
+	}
+	return f.storeFrom(f.rules)
+}
 
-		return nil
+// storeFrom builds a fresh matcher from rules plus the except rules and swaps it in, the live matcher is
+// never modified.
+func (f *PForward) storeFrom(rules []Rule) error {
+	from, err := new(Matcher).Insert(rules)
+	if err != nil {
+		return err
+	}
+	if from, err = from.Insert(f.except); err != nil {
+		return err
 	}
+	f.from.Store(from)
 
-	zones := plugin.Host(path).NormalizeExact()
-	if len(zones) == 0 {
-		return fmt.Errorf("unable to normalize '%s'", path)
+	return nil
+}
+
+// loadClients loads the from_client file into a fresh client set. Without from_client any client matches.
+func (f *PForward) loadClients() error {
+	if f.clientWatcher != nil {
+		_, err := f.clientWatcher.reload()
+		return err
+	}
+	if len(f.clientCIDRs) > 0 {
+		return f.storeClients(nil)
 	}
+	return nil
+}
 
-	for _, domain := range zones {
-		from = InsertDomain(domain, from)
+// storeClients builds a fresh client set from prefixes plus the inline networks and swaps it in.
+func (f *PForward) storeClients(prefixes []netip.Prefix) error {
+	clients := newIPTrie(f.clientCIDRs)
+	for _, prefix := range prefixes {
+		clients.Insert(prefix)
 	}
-	f.from.Store(from)
+	f.clients.Store(clients)
 
 	return nil
 }
@@ -195,22 +327,21 @@ func parseStanza(c *caddy.Controller) (*PForward, error) {
 		return f, c.ArgErr()
 	}
 
-	toHosts, err := parse.HostPortOrFile(to...)
+	specs, err := parseTo(to)
 	if err != nil {
 		return f, err
 	}
-
-	transports := make([]string, len(toHosts))
-	allowedTrans := map[string]bool{"dns": true, "tls": true}
-	for i, host := range toHosts {
-		trans, h := parse.Transport(host)
-
-		if !allowedTrans[trans] {
-			return f, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
+	for _, spec := range specs {
+		var p Upstream
+		if spec.hostname != "" {
+			p = newHostProxy(spec.addr)
+		} else {
+			p = newUpstream(spec)
 		}
-		p := proxy.NewProxy("forward", h, trans)
 		f.proxies = append(f.proxies, p)
-		transports[i] = trans
+		if spec.weight > 0 {
+			f.weights[p] = spec.weight
+		}
 	}
 
 	for c.NextBlock() {
@@ -219,6 +350,31 @@ func parseStanza(c *caddy.Controller) (*PForward, error) {
 		}
 	}
 
+	if f.reload != nil {
+		if f.watcher == nil && f.clientWatcher == nil {
+			return f, errors.New("reload requires a ruleset or from_client file")
+		}
+		if f.watcher != nil {
+			f.watcher.interval = *f.reload
+		}
+		if f.clientWatcher != nil {
+			f.clientWatcher.interval = *f.reload
+		}
+	}
+
+	if wrr, ok := f.p.(*weightedRoundRobin); ok {
+		wrr.weights, wrr.maxfails = f.weights, f.maxfails
+	} else if len(f.weights) > 0 {
+		return f, fmt.Errorf("upstream weights require policy weighted_round_robin, got %s", f.p)
+	}
+
+	if err := f.loadFrom(); err != nil {
+		return f, err
+	}
+	if err := f.loadClients(); err != nil {
+		return f, err
+	}
+
 	if f.tlsServerName != "" {
 		f.tlsConfig.ServerName = f.tlsServerName
 	}
@@ -227,21 +383,169 @@ func parseStanza(c *caddy.Controller) (*PForward, error) {
 	// in upcoming connections to the same TLS server.
 	f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(f.proxies))
 
+	if f.egress != nil && !f.egress.udp() {
+		// everything goes over TCP then
+		f.opts.ForceTCP = true
+	}
+
+	if f.bootstrap != nil {
+		f.bootstrap.dial = new(net.Dialer).DialContext
+		if f.egress != nil {
+			f.bootstrap.dial, f.bootstrap.tcp = f.egress.DialContext, !f.egress.udp()
+		}
+	}
+
 	for i := range f.proxies {
+		specs[i].opts = f.overrides[specs[i].addr]
+		p, err := f.configure(f.proxies[i], specs[i])
+		if err != nil {
+			return f, err
+		}
+		if p != f.proxies[i] {
+			f.replaceUpstream(f.proxies[i], p)
+		}
+		if specs[i].opts != nil && specs[i].opts.forceTCP {
+			f.forceTCP[p] = true
+		}
+	}
+
+	return f, nil
+}
+
+// newUpstream returns the upstream of spec, which must have an IP address.
+func newUpstream(spec upstreamSpec) Upstream {
+	switch spec.trans {
+	case transport.HTTPS:
+		return newDoHProxy(spec.addr, spec.path)
+	case transport.QUIC:
+		return newDoQProxy(spec.addr)
+	case transportDNSCrypt:
+		return newDNSCryptProxy(spec.addr, spec.stamp.providerName, spec.stamp.providerPK)
+	default:
+		return proxy.NewProxy("forward", spec.addr, spec.trans)
+	}
+}
+
+// configure applies the options of the stanza to p, the upstream of spec. It returns the upstream to use
+// instead, which differs from p when p can't do what the options ask for.
+func (f *PForward) configure(p Upstream, spec upstreamSpec) (Upstream, error) {
+	o := spec.opts
+	if o == nil {
+		o = new(upstreamOpts)
+	}
+	tlsConfig := f.tlsConfig
+	if o.tlsConfig != nil {
+		tlsConfig = o.tlsConfig
+	}
+	if spec.stamp != nil {
+		tlsConfig = spec.stamp.tlsConfig(tlsConfig)
+	}
+	// the server name of the upstream block wins over the one after '#', the stanza's and the hostname
+	serverName := spec.serverName
+	if o.serverName != "" {
+		serverName = o.serverName
+	}
+	if serverName == "" && spec.hostname != "" && f.tlsServerName == "" {
+		serverName = spec.hostname
+	}
+	if serverName != "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = serverName
+	}
+	expire, forceTCP := f.expire, f.opts.ForceTCP || o.forceTCP
+	if o.expire > 0 {
+		expire = o.expire
+	}
+	if spec.trans == transport.QUIC && f.egress != nil && !f.egress.udp() {
+		return nil, fmt.Errorf("egress %s can't carry QUIC to %s", f.egress, spec.addr)
+	}
+
+	if pp, ok := p.(*proxy.Proxy); ok && f.egress != nil {
+		// proxy.Proxy can't dial through the egress
+		p = newDialProxy(pp.Addr(), spec.trans, f.egress.DialContext)
+	}
+
+	switch p := p.(type) {
+	case *proxy.Proxy:
 		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			f.proxies[i].SetTLSConfig(f.tlsConfig)
+		if spec.trans == transport.TLS {
+			p.SetTLSConfig(tlsConfig)
 		}
-		f.proxies[i].SetExpire(f.expire)
-		f.proxies[i].GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
+		p.SetExpire(expire)
+		p.GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
 		// when TLS is used, checks are set to tcp-tls
-		if f.opts.ForceTCP && transports[i] != transport.TLS {
-			f.proxies[i].GetHealthchecker().SetTCPTransport()
+		if forceTCP && spec.trans != transport.TLS {
+			p.GetHealthchecker().SetTCPTransport()
+		}
+		p.GetHealthchecker().SetDomain(f.opts.HCDomain)
+	case *dialProxy:
+		if spec.trans == transport.TLS {
+			p.SetTLSConfig(tlsConfig)
+		}
+		p.SetExpire(expire)
+		p.recursionDesired, p.domain, p.tcp = f.opts.HCRecursionDesired, f.opts.HCDomain, forceTCP
+	case *dohProxy:
+		if f.egress != nil {
+			p.dial = f.egress.DialContext
+		}
+		p.SetTLSConfig(tlsConfig)
+		p.SetExpire(expire)
+		p.method = f.dohMethod
+		if spec.stamp != nil && spec.stamp.hostname != "" {
+			p.url = "https://" + spec.stamp.hostname + spec.path
+		}
+		if spec.hostname != "" {
+			_, port, _ := net.SplitHostPort(spec.addr)
+			host := spec.hostname
+			if port != transport.HTTPSPort {
+				host = net.JoinHostPort(host, port)
+			}
+			p.url = "https://" + host + spec.path
+		}
+		p.recursionDesired, p.domain = f.opts.HCRecursionDesired, f.opts.HCDomain
+	case *doqProxy:
+		if f.egress != nil {
+			p.listenPacket = f.egress.ListenPacket
+		}
+		p.SetTLSConfig(tlsConfig)
+		p.SetExpire(expire)
+		p.recursionDesired, p.domain = f.opts.HCRecursionDesired, f.opts.HCDomain
+	case *dnscryptProxy:
+		if f.egress != nil {
+			p.dial = f.egress.DialContext
+		}
+		p.recursionDesired, p.domain, p.tcp = f.opts.HCRecursionDesired, f.opts.HCDomain, forceTCP
+	case *hostProxy:
+		if f.bootstrap == nil {
+			return nil, fmt.Errorf("upstream %s is a hostname, it needs bootstrap servers to resolve it", spec.addr)
+		}
+		p.resolver, p.maxfails = f.bootstrap, f.maxfails
+		p.spawn = func(addr string) Upstream {
+			// the hostname stays for the server name
+			child := spec
+			child.addr = addr
+			c, _ := f.configure(newUpstream(child), child) // errors are caught configuring p
+			return c
 		}
-		f.proxies[i].GetHealthchecker().SetDomain(f.opts.HCDomain)
 	}
+	return p, nil
+}
 
-	return f, nil
+// replaceUpstream puts p in the place of old, keeping its weight and latencies.
+func (f *PForward) replaceUpstream(old, p Upstream) {
+	for i := range f.proxies {
+		if f.proxies[i] == old {
+			f.proxies[i] = p
+		}
+	}
+	if w, ok := f.weights[old]; ok {
+		delete(f.weights, old)
+		f.weights[p] = w
+	}
+	if h, ok := f.latencies[old]; ok {
+		delete(f.latencies, old)
+		f.latencies[p] = h
+	}
 }
 
 func parseBlock(c *caddy.Controller, f *PForward) error {
@@ -299,21 +603,70 @@ func parseBlock(c *caddy.Controller, f *PForward) error {
 		}
 		f.opts.PreferUDP = true
 	case "tls":
+		tlsConfig, err := parseTLS(c)
+		if err != nil {
+			return err
+		}
+		f.tlsConfig = tlsConfig
+	case "upstream":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		specs, err := parseTo([]string{c.Val()})
+		if err != nil {
+			return err
+		}
+		o, err := parseUpstreamOpts(c)
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			found := false
+			for _, p := range f.proxies {
+				found = found || p.Addr() == spec.addr
+			}
+			if !found {
+				return fmt.Errorf("upstream: '%s' is not a configured upstream", spec.addr)
+			}
+			f.overrides[spec.addr] = o
+		}
+	case "bootstrap":
 		args := c.RemainingArgs()
-		if len(args) > 3 {
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
-
-		for i := range args {
-			if !filepath.IsAbs(args[i]) && config.Root != "" {
-				args[i] = filepath.Join(config.Root, args[i])
+		servers, err := parse.HostPortOrFile(args...)
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			if trans, _ := parse.Transport(server); trans != transport.DNS {
+				return fmt.Errorf("bootstrap servers must be plain DNS: %s", server)
 			}
 		}
-		tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+		f.bootstrap = &bootstrap{servers: servers}
+	case "egress":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		e, err := parseEgress(c.Val())
 		if err != nil {
 			return err
 		}
-		f.tlsConfig = tlsConfig
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.egress = e
+	case "doh_method":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch method := strings.ToUpper(c.Val()); method {
+		case http.MethodGet, http.MethodPost:
+			f.dohMethod = method
+		default:
+			return fmt.Errorf("doh_method must be GET or POST: %s", c.Val())
+		}
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -342,6 +695,31 @@ func parseBlock(c *caddy.Controller, f *PForward) error {
 			f.p = &roundRobin{}
 		case "sequential":
 			f.p = &sequential{}
+		case "fastest":
+			f.p = &fastest{}
+		case "least_outstanding":
+			f.p = &leastOutstanding{}
+		case "weighted_round_robin":
+			f.p = &weightedRoundRobin{}
+		case "hash":
+			f.p = &hash{}
+		case "sticky_client":
+			r := &stickyClient{v4: defaultStickyV4, v6: defaultStickyV6}
+			for i, bits := range []*int{&r.v4, &r.v6} {
+				limit := []int{32, 128}[i]
+				if !c.NextArg() {
+					break
+				}
+				n, err := strconv.Atoi(strings.TrimPrefix(c.Val(), "/"))
+				if err != nil || !strings.HasPrefix(c.Val(), "/") || n < 0 || n > limit {
+					return c.Errf("invalid sticky_client prefix length '%s'", c.Val())
+				}
+				*bits = n
+			}
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			f.p = r
 		default:
 			return c.Errf("unknown policy '%s'", x)
 		}
@@ -359,23 +737,221 @@ func parseBlock(c *caddy.Controller, f *PForward) error {
 		f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum " + c.Val())
 		f.maxConcurrent = int64(n)
 	case "backup_request":
-		if !c.NextArg() {
+		args := c.RemainingArgs()
+		if len(args) > 0 && args[0] == "auto" {
+			if len(args) < 2 {
+				return c.ArgErr()
+			}
+			percentile, err := parsePercentile(args[1])
+			if err != nil {
+				return err
+			}
+			f.backupPercentile = percentile
+			f.latencies = make(map[Upstream]*latencyHistogram)
+			for _, p := range f.proxies {
+				f.latencies[p] = new(latencyHistogram)
+			}
+			args = append([]string{autoBackupFallback.String()}, args[2:]...)
+		}
+		if len(args) == 0 || len(args) > 3 {
 			return c.ArgErr()
 		}
-		backupDuration, err := time.ParseDuration(c.Val())
+		backupDuration, err := time.ParseDuration(args[0])
 		if err != nil {
 			return c.ArgErr()
 		}
+		if backupDuration < 0 {
+			return fmt.Errorf("backup_request can't be negative: %s", backupDuration)
+		}
+
+		maxHedges, ratio := 1, defaultHedgeRatio
+		if len(args) > 1 {
+			if maxHedges, err = strconv.Atoi(args[1]); err != nil {
+				return c.ArgErr()
+			}
+			if maxHedges < 1 {
+				return fmt.Errorf("backup_request max_hedges must be positive: %d", maxHedges)
+			}
+		}
+		if len(args) > 2 {
+			if ratio, err = strconv.ParseFloat(args[2], 64); err != nil {
+				return c.ArgErr()
+			}
+			if ratio <= 0 {
+				return fmt.Errorf("backup_request ratio must be positive: %s", args[2])
+			}
+		}
 		f.backupDuration = backupDuration
-		/* // 暂不支持 threshold
-		threshold := 0.1
-		if c.NextArg() {
-			threshold, err = strconv.ParseFloat(c.Val(), 64)
+		f.maxHedges = maxHedges
+		f.budget = newHedgeBudget(ratio)
+	case "weight":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		weight, err := strconv.Atoi(args[1])
+		if err != nil || weight < 1 {
+			return fmt.Errorf("weight must be a positive integer: %s", args[1])
+		}
+		specs, err := parseTo(args[:1])
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			found := false
+			for _, p := range f.proxies {
+				if p.Addr() == spec.addr {
+					f.weights[p], found = weight, true
+				}
+			}
+			if !found {
+				return fmt.Errorf("weight: '%s' is not a configured upstream", args[0])
+			}
+		}
+	case "except":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+
+		for _, arg := range args {
+			rules, err := parseRule("!" + arg)
+			if len(rules) == 0 || err != nil {
+				return fmt.Errorf("unable to normalize '%s' '%v'", arg, err)
+			}
+			f.except = append(f.except, rules...)
+		}
+	case "reload":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("reload can't be negative: %s", dur)
+		}
+		// applied once the block is parsed, from_client may follow
+		f.reload = &dur
+	case "qtype":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+
+		qtypes, err := parseQtypes(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if f.qtypes == nil {
+			f.qtypes = qtypes
+		} else if err := f.qtypes.merge(qtypes); err != nil {
+			return c.Err(err.Error())
+		}
+	case "format":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		format, ok := rulesetFormats[c.Val()]
+		if !ok {
+			return c.Errf("unknown ruleset format '%s'", c.Val())
+		}
+		switch {
+		case f.remote != nil:
+			f.remote.format = format
+		case f.watcher == nil || strings.HasPrefix(f.watcher.path, geositePrefix):
+			return c.Errf("format requires a ruleset file")
+		default:
+			f.watcher.read = rulesetReader(format)
+		}
+	case "cache_dir":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if f.remote == nil {
+			return c.Errf("cache_dir requires a ruleset URL")
+		}
+		dir := c.Val()
+		if !filepath.IsAbs(dir) && config.Root != "" {
+			dir = filepath.Join(config.Root, dir)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return c.Errf("invalid cache_dir '%s': %v", dir, err)
+		}
+		f.remote.cacheDir = dir
+	case "verify":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		if f.remote == nil {
+			return c.Errf("verify requires a ruleset URL")
+		}
+		switch {
+		case args[0] == "sha256" && len(args) == 1:
+			f.remote.verifier = &sha256Verifier{}
+		case args[0] == "sha256":
+			sum, err := hex.DecodeString(args[1])
+			if err != nil || len(sum) != sha256.Size {
+				return c.Errf("invalid sha256 '%s'", args[1])
+			}
+			f.remote.verifier = &sha256Verifier{sum: sum}
+		case args[0] == "minisign" && len(args) == 2:
+			v, err := parseMinisignKey(args[1])
 			if err != nil {
-				return c.ArgErr()
+				return c.Err(err.Error())
 			}
+			f.remote.verifier = v
+		default:
+			return c.Errf("unknown verify method '%s'", strings.Join(args, " "))
+		}
+	case "from_client":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+
+		for _, arg := range args {
+			if prefix, err := parsePrefix(arg); err == nil {
+				f.clientCIDRs = append(f.clientCIDRs, prefix)
+				continue
+			}
+			if f.clientWatcher != nil {
+				return c.Errf("from_client takes at most one file, got '%s'", arg)
+			}
+			path := cidrPath(arg, config.Root)
+			if info, err := os.Stat(path); !strings.HasPrefix(path, geoipPrefix) && (err != nil || info.IsDir()) {
+				return c.Errf("invalid from_client '%s': not a cidr nor a file", arg)
+			}
+			f.clientWatcher = &fileWatcher[[]netip.Prefix]{
+				path: path, kind: "clients", interval: defaultReload, read: readPrefixes, store: f.storeClients,
+			}
+		}
+	case "geoip":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
 		}
-		*/
+
+		g := &geoip{path: cidrPath(args[0], config.Root)}
+		if len(args) == 2 {
+			switch args[1] {
+			case "inside":
+				g.inside = true
+			case "outside":
+				g.inside = false
+			default:
+				return c.Errf("unknown geoip mode '%s'", args[1])
+			}
+		}
+
+		cidrs, err := readCIDRs(g.path)
+		if err != nil {
+			return err
+		}
+		g.cidrs = cidrs
+		f.geoip = g
 
 	default:
 		return c.Errf("unknown property '%s'", c.Val())
@@ -384,4 +960,168 @@ func parseBlock(c *caddy.Controller, f *PForward) error {
 	return nil
 }
 
+// upstreamSpec is an upstream parsed from the TO list.
+type upstreamSpec struct {
+	trans  string
+	addr   string // host:port
+	path   string // only for https
+	weight int    // 0: not set
+	stamp  *stamp // nil unless configured with a sdns:// stamp
+
+	hostname   string        // set when given by name, also the server name
+	serverName string        // from "addr#name"
+	opts       *upstreamOpts // from the upstream block, nil: none
+}
+
+// upstreamOpts are the options of an upstream block, they override those of the stanza for one upstream.
+type upstreamOpts struct {
+	serverName string
+	tlsConfig  *tls.Config   // nil: the stanza's
+	expire     time.Duration // 0: the stanza's
+	forceTCP   bool
+}
+
+// parseUpstreamOpts parses the block of "upstream ADDR { ... }". The dispenser doesn't nest blocks, so
+// the tokens are walked up to the closing brace.
+func parseUpstreamOpts(c *caddy.Controller) (*upstreamOpts, error) {
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Errf("upstream: expected a block")
+	}
+	o := new(upstreamOpts)
+	for {
+		if !c.Next() {
+			return nil, c.Errf("upstream: unterminated block")
+		}
+		switch c.Val() {
+		case "}":
+			return o, nil
+		case "tls_servername":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			o.serverName = c.Val()
+		case "tls":
+			tlsConfig, err := parseTLS(c)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+			o.tlsConfig = tlsConfig
+		case "expire":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			if dur <= 0 {
+				return nil, fmt.Errorf("expire must be positive: %s", dur)
+			}
+			o.expire = dur
+		case "force_tcp":
+			o.forceTCP = true
+		default:
+			return nil, c.Errf("unknown upstream property '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return nil, c.ArgErr()
+		}
+	}
+}
+
+// parseTLS parses the arguments of tls, relative paths are taken from the root.
+func parseTLS(c *caddy.Controller) (*tls.Config, error) {
+	args := c.RemainingArgs()
+	if len(args) > 3 {
+		return nil, c.ArgErr()
+	}
+
+	config := dnsserver.GetConfig(c)
+	for i := range args {
+		if !filepath.IsAbs(args[i]) && config.Root != "" {
+			args[i] = filepath.Join(config.Root, args[i])
+		}
+	}
+	return pkgtls.NewTLSConfigFromArgs(args...)
+}
+
+// parseTo parses the TO list: addresses with an optional transport, path and weight, resolv.conf like
+// files, and sdns:// stamps.
+func parseTo(to []string) ([]upstreamSpec, error) {
+	allowedTrans := map[string]bool{"dns": true, "tls": true, "https": true, "quic": true}
+	var specs []upstreamSpec
+	for _, addr := range to {
+		addr, weight, err := cutWeight(addr)
+		if err != nil {
+			return nil, err
+		}
+		addr, serverName := cutServerName(addr)
+
+		if strings.HasPrefix(addr, "sdns://") {
+			st, err := parseStamp(addr)
+			if err != nil {
+				return nil, err
+			}
+			spec := st.spec()
+			spec.weight, spec.serverName = weight, serverName
+			specs = append(specs, spec)
+			continue
+		}
+
+		addr, path := cutPath(addr)
+		if spec, ok := hostnameSpec(addr, path); ok {
+			if !allowedTrans[spec.trans] {
+				return nil, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", spec.trans, addr)
+			}
+			spec.weight, spec.serverName = weight, serverName
+			specs = append(specs, spec)
+			continue
+		}
+		hosts, err := parse.HostPortOrFile(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			trans, h := parse.Transport(host)
+			if !allowedTrans[trans] {
+				return nil, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
+			}
+			specs = append(specs, upstreamSpec{trans: trans, addr: h, path: path, weight: weight, serverName: serverName})
+		}
+	}
+	return specs, nil
+}
+
+// cutWeight splits an upstream written as "addr^weight", weight=0 when it is not given.
+func cutWeight(addr string) (string, int, error) {
+	i := strings.LastIndexByte(addr, '^')
+	if i < 0 {
+		return addr, 0, nil
+	}
+	weight, err := strconv.Atoi(addr[i+1:])
+	if err != nil || weight < 1 {
+		return addr, 0, fmt.Errorf("weight must be a positive integer: %s", addr)
+	}
+	return addr[:i], weight, nil
+}
+
+// cutServerName splits an upstream written as "addr#name", the name is the TLS server name of the upstream.
+func cutServerName(addr string) (string, string) {
+	addr, name, _ := strings.Cut(addr, "#")
+	return addr, name
+}
+
+// parsePercentile parses a percentile written as "pNN", e.g. "p95" or "p99.9", into a fraction.
+func parsePercentile(s string) (float64, error) {
+	if !strings.HasPrefix(s, "p") {
+		return 0, fmt.Errorf("invalid percentile '%s'", s)
+	}
+	percentile, err := strconv.ParseFloat(s[1:], 64)
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return 0, fmt.Errorf("invalid percentile '%s'", s)
+	}
+	return percentile / 100, nil
+}
+
 const max = 15 // Maximum number of upstreams.
@@ -0,0 +1,202 @@
+package pforward
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(path, []byte("google.com\nyoutube.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "pforward "+path+" 127.0.0.1 {\nexcept mail.google.com\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+
+	// lookups run concurrently with reloads, go test -race reports any write to a live matcher
+	var (
+		wg   sync.WaitGroup
+		stop atomic.Bool
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				f.from.Load().Match("www.google.com.")
+				f.from.Load().Match("mail.google.com.")
+				f.from.Load().Match("www.youtube.com.")
+			}
+		}()
+	}
+
+	// unchanged content is not swapped, so every reload gets a different file
+	for i := 0; i < 50; i++ {
+		rules := "google.com\nyoutube.com\n"
+		if i%2 == 0 {
+			rules += "twitter.com\n"
+		}
+		if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		from := f.from.Load()
+		if err := f.loadFrom(); err != nil {
+			t.Fatal(err)
+		}
+		if f.from.Load() == from {
+			t.Fatalf("reload %d: expected the matcher to be swapped", i)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("google.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.loadFrom(); err != nil {
+		t.Fatal(err)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	tests := map[string]bool{
+		"www.google.com.":  true,
+		"mail.google.com.": false,
+		"www.youtube.com.": false,
+	}
+	for domain, expected := range tests {
+		if got := f.from.Load().Match(domain); got != expected {
+			t.Errorf("domain=%s expected=%v got=%v", domain, expected, got)
+		}
+	}
+
+	// a broken ruleset keeps the last good matcher
+	if err := os.WriteFile(path, []byte("regexp:(\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.loadFrom(); err == nil {
+		t.Fatal("expected error for broken ruleset")
+	}
+	if !f.from.Load().Match("www.google.com.") {
+		t.Error("expected last good ruleset to be kept")
+	}
+}
+
+func TestUpstreamOpts(t *testing.T) {
+	c := caddy.NewTestController("dns", `pforward . "https://1.1.1.1#cloudflare-dns.com" https://8.8.8.8 https://9.9.9.9 {
+tls_servername dns.quad9.net
+expire 5s
+upstream https://8.8.8.8 {
+    tls_servername dns.google
+    expire 30s
+    force_tcp
+}
+}`)
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+
+	tests := []struct {
+		serverName string
+		expire     time.Duration
+		forceTCP   bool
+	}{
+		{"cloudflare-dns.com", 5 * time.Second, false},
+		{"dns.google", 30 * time.Second, true},
+		{"dns.quad9.net", 5 * time.Second, false},
+	}
+	for i, tc := range tests {
+		p := f.proxies[i].(*dohProxy)
+		if name := p.transport.TLSClientConfig.ServerName; name != tc.serverName {
+			t.Errorf("Test %d: expected server name %s, got %s", i, tc.serverName, name)
+		}
+		if p.transport.IdleConnTimeout != tc.expire {
+			t.Errorf("Test %d: expected expire %s, got %s", i, tc.expire, p.transport.IdleConnTimeout)
+		}
+		if f.forceTCP[p] != tc.forceTCP {
+			t.Errorf("Test %d: expected force_tcp %t", i, tc.forceTCP)
+		}
+	}
+	if f.tlsConfig.ServerName != "dns.quad9.net" {
+		t.Errorf("expected the stanza server name to stay, got %s", f.tlsConfig.ServerName)
+	}
+}
+
+func TestUpstreamForceTCP(t *testing.T) {
+	defaultTimeout = 5 * time.Second
+
+	var tcp int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			atomic.AddInt32(&tcp, 1)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	}
+	s1, s2 := newServer(t, handler), newServer(t, handler)
+
+	c := caddy.NewTestController("dns", "pforward . "+s1+" "+s2+" {\npolicy sequential\nupstream "+s2+" {\nforce_tcp\n}\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	for i, p := range f.proxies {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		state := request.Request{W: rec, Req: m}
+		if _, err := f.connect(context.TODO(), p, state, f.opts, false); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but didn't: %v", i, err)
+		}
+		if n := atomic.LoadInt32(&tcp); n != int32(i) {
+			t.Errorf("Test %d: expected %d queries over TCP, got %d", i, i, n)
+		}
+	}
+}
+
+func TestUpstreamOptsParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"pforward . \"tls://1.1.1.1#cloudflare-dns.com^2\" {\npolicy weighted_round_robin\n}", false},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\n}\n}", false},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\ntls_servername one.one.one.one\n}\nexpire 3s\n}", false},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.0.0.1 {\nforce_tcp\n}\n}", true},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\nmax_fails 3\n}\n}", true},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\nexpire 0s\n}\n}", true},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\nforce_tcp yes\n}\n}", true},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1\n}", true},
+		{"pforward . tls://1.1.1.1 {\nupstream tls://1.1.1.1 {\nforce_tcp\n", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parseForward(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %t, got %v", i, test.shouldErr, err)
+		}
+	}
+}
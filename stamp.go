@@ -0,0 +1,205 @@
+package pforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// DNS stamp protocols, see https://dnscrypt.info/stamps-specifications.
+const (
+	stampPlain    = 0x00
+	stampDNSCrypt = 0x01
+	stampDoH      = 0x02
+	stampDoT      = 0x03
+	stampDoQ      = 0x04
+)
+
+// transportDNSCrypt is the transport of DNSCrypt upstreams, they can only be configured with a stamp.
+const transportDNSCrypt = "dnscrypt"
+
+// stamp is a decoded sdns:// DNS stamp.
+type stamp struct {
+	proto byte
+	addr  string // host:port
+
+	// DNSCrypt
+	providerPK   []byte
+	providerName string
+
+	// DoH, DoT and DoQ
+	hashes   [][]byte // SHA256 of the TBS certificate of one of the certificates in the chain, any matches
+	hostname string   // server name, for DoH also the host of the URL
+	path     string   // DoH
+}
+
+var errShortStamp = errors.New("stamp is too short")
+
+// parseStamp decodes a sdns:// stamp.
+func parseStamp(s string) (*stamp, error) {
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp '%s': %v", s, err)
+	}
+	if len(bin) < 9 {
+		return nil, fmt.Errorf("invalid stamp '%s': %v", s, errShortStamp)
+	}
+
+	st := &stamp{proto: bin[0]}
+	r := &stampReader{bin: bin[9:]} // skip the props, they describe the resolver, not how to reach it
+	var port string
+	switch st.proto {
+	case stampPlain:
+		st.addr, port = r.lp(), transport.Port
+	case stampDNSCrypt:
+		st.addr, port = r.lp(), "443"
+		st.providerPK = []byte(r.lp())
+		st.providerName = r.lp()
+	case stampDoH, stampDoT, stampDoQ:
+		st.addr = r.lp()
+		for _, h := range r.vlp() {
+			if len(h) > 0 {
+				st.hashes = append(st.hashes, []byte(h))
+			}
+		}
+		st.hostname = r.lp()
+		port = transport.TLSPort
+		if st.proto == stampDoH {
+			st.path, port = r.lp(), transport.HTTPSPort
+		}
+	default:
+		return nil, fmt.Errorf("invalid stamp '%s': unsupported protocol %#x", s, st.proto)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid stamp '%s': %v", s, r.err)
+	}
+
+	if st.proto == stampDNSCrypt && (len(st.providerPK) != 32 || st.providerName == "") {
+		return nil, fmt.Errorf("invalid stamp '%s': bad provider key or name", s)
+	}
+	for _, h := range st.hashes {
+		if len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid stamp '%s': bad certificate hash", s)
+		}
+	}
+	if st.addr == "" {
+		return nil, fmt.Errorf("stamp '%s' has no IP address", s)
+	}
+	if st.addr, err = stampAddr(st.addr, st.hostname, port); err != nil {
+		return nil, fmt.Errorf("invalid stamp '%s': %v", s, err)
+	}
+	return st, nil
+}
+
+// stampAddr adds the port to addr, taken from hostname or the protocol default.
+func stampAddr(addr, hostname, port string) (string, error) {
+	if host, p, err := net.SplitHostPort(addr); err == nil {
+		addr, port = host, p
+	} else if _, p, err := net.SplitHostPort(hostname); err == nil {
+		port = p
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("not an IP address: %q", addr)
+	}
+	return net.JoinHostPort(addr, port), nil
+}
+
+// spec returns the upstream the stamp describes.
+func (st *stamp) spec() upstreamSpec {
+	spec := upstreamSpec{addr: st.addr, path: st.path, stamp: st}
+	switch st.proto {
+	case stampPlain:
+		spec.trans = transport.DNS
+	case stampDNSCrypt:
+		spec.trans = transportDNSCrypt
+	case stampDoH:
+		spec.trans = transport.HTTPS
+	case stampDoT:
+		spec.trans = transport.TLS
+	case stampDoQ:
+		spec.trans = transport.QUIC
+	}
+	return spec
+}
+
+// serverName returns the hostname without port.
+func (st *stamp) serverName() string {
+	if host, _, err := net.SplitHostPort(st.hostname); err == nil {
+		return host
+	}
+	return st.hostname
+}
+
+// tlsConfig returns a copy of cfg with the server name and certificate pins of the stamp.
+func (st *stamp) tlsConfig(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	if name := st.serverName(); name != "" {
+		cfg.ServerName = name
+	}
+	if len(st.hashes) > 0 {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawTBSCertificate)
+				for _, h := range st.hashes {
+					if bytes.Equal(sum[:], h) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate of %s matches the stamp", st.addr)
+		}
+	}
+	return cfg
+}
+
+// stampReader reads the length prefixed fields of a stamp, the first error sticks.
+type stampReader struct {
+	bin []byte
+	err error
+}
+
+// lp reads a length prefixed string.
+func (r *stampReader) lp() string {
+	if r.err != nil {
+		return ""
+	}
+	if len(r.bin) < 1 || len(r.bin) < 1+int(r.bin[0]) {
+		r.err = errShortStamp
+		return ""
+	}
+	n := int(r.bin[0])
+	s := string(r.bin[1 : 1+n])
+	r.bin = r.bin[1+n:]
+	return s
+}
+
+// vlp reads a set of length prefixed strings, the high bit of the length marks that more follow.
+func (r *stampReader) vlp() []string {
+	var set []string
+	for r.err == nil {
+		if len(r.bin) < 1 {
+			r.err = errShortStamp
+			return nil
+		}
+		more := r.bin[0]&0x80 != 0
+		n := int(r.bin[0] &^ 0x80)
+		if len(r.bin) < 1+n {
+			r.err = errShortStamp
+			return nil
+		}
+		set = append(set, string(r.bin[1:1+n]))
+		r.bin = r.bin[1+n:]
+		if !more {
+			break
+		}
+	}
+	return set
+}
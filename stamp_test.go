@@ -0,0 +1,122 @@
+package pforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// encodeStamp is the inverse of parseStamp, hashes are not supported.
+func encodeStamp(st *stamp) string {
+	bin := []byte{st.proto}
+	bin = binary.LittleEndian.AppendUint64(bin, 0)
+	lp := func(s string) { bin = append(append(bin, byte(len(s))), s...) }
+	lp(st.addr)
+	switch st.proto {
+	case stampDNSCrypt:
+		lp(string(st.providerPK))
+		lp(st.providerName)
+	case stampDoH, stampDoT, stampDoQ:
+		bin = append(bin, 0) // no hashes
+		lp(st.hostname)
+		if st.proto == stampDoH {
+			lp(st.path)
+		}
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func TestParseStamp(t *testing.T) {
+	pk := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		in   *stamp
+		spec upstreamSpec
+	}{
+		{&stamp{proto: stampPlain, addr: "8.8.8.8"}, upstreamSpec{trans: transport.DNS, addr: "8.8.8.8:53"}},
+		{&stamp{proto: stampDNSCrypt, addr: "[2001:db8::1]:5353", providerPK: pk, providerName: "2.dnscrypt-cert.example.org"}, upstreamSpec{trans: transportDNSCrypt, addr: "[2001:db8::1]:5353"}},
+		{&stamp{proto: stampDoH, addr: "1.1.1.1", hostname: "cloudflare-dns.com", path: "/dns-query"}, upstreamSpec{trans: transport.HTTPS, addr: "1.1.1.1:443", path: "/dns-query"}},
+		{&stamp{proto: stampDoT, addr: "9.9.9.9", hostname: "dns.quad9.net:8853"}, upstreamSpec{trans: transport.TLS, addr: "9.9.9.9:8853"}},
+		{&stamp{proto: stampDoQ, addr: "94.140.14.14", hostname: "dns.adguard.com"}, upstreamSpec{trans: transport.QUIC, addr: "94.140.14.14:853"}},
+	}
+	for _, tc := range tests {
+		s := encodeStamp(tc.in)
+		st, err := parseStamp(s)
+		if err != nil {
+			t.Fatalf("stamp=%s unexpected error: %v", s, err)
+		}
+		spec := st.spec()
+		if spec.trans != tc.spec.trans || spec.addr != tc.spec.addr || spec.path != tc.spec.path {
+			t.Errorf("stamp=%s expected %+v, got %+v", s, tc.spec, spec)
+		}
+		if st.hostname != tc.in.hostname || st.providerName != tc.in.providerName || !bytes.Equal(st.providerPK, tc.in.providerPK) {
+			t.Errorf("stamp=%s expected %+v, got %+v", s, tc.in, st)
+		}
+	}
+
+	// hashes are a set, the high bit of the length marks that more follow
+	h1, h2 := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	bin := binary.LittleEndian.AppendUint64([]byte{stampDoT}, 0)
+	bin = append(append(bin, 7), "1.0.0.1"...)
+	bin = append(append(bin, 0x80|32), h1[:]...)
+	bin = append(append(bin, 32), h2[:]...)
+	bin = append(append(bin, 3), "one"...)
+	st, err := parseStamp("sdns://" + base64.RawURLEncoding.EncodeToString(bin))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(st.hashes) != 2 || !bytes.Equal(st.hashes[1], h2[:]) || st.hostname != "one" {
+		t.Errorf("unexpected stamp %+v", st)
+	}
+
+	for _, s := range []string{
+		"sdns://",
+		"sdns://!!!",
+		encodeStamp(&stamp{proto: 0x05, addr: "1.1.1.1"}),
+		encodeStamp(&stamp{proto: stampDNSCrypt, addr: "1.1.1.1", providerPK: pk[:16], providerName: "2.dnscrypt-cert.example.org"}),
+		encodeStamp(&stamp{proto: stampDoH, hostname: "dns.example.org", path: "/dns-query"}),
+		encodeStamp(&stamp{proto: stampDoT, addr: "dns.example.org", hostname: "dns.example.org"}),
+		"sdns://" + base64.RawURLEncoding.EncodeToString(bin[:len(bin)-2]),
+	} {
+		if _, err := parseStamp(s); err == nil {
+			t.Errorf("stamp=%s expected error", s)
+		}
+	}
+}
+
+func TestStampParse(t *testing.T) {
+	dot := encodeStamp(&stamp{proto: stampDoT, addr: "9.9.9.9", hostname: "dns.quad9.net"})
+	doh := encodeStamp(&stamp{proto: stampDoH, addr: "1.1.1.1", hostname: "cloudflare-dns.com", path: "/dns-query"})
+	c := caddy.NewTestController("dns", "pforward . "+dot+"^2 "+doh+" 127.0.0.1 {\npolicy weighted_round_robin\ntls_servername example.org\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+
+	p, ok := f.proxies[0].(*proxy.Proxy)
+	if !ok || p.Addr() != "9.9.9.9:853" || f.weights[p] != 2 {
+		t.Fatalf("expected DoT upstream 9.9.9.9:853 with weight 2, got %s", f.proxies[0].Addr())
+	}
+	if name := p.GetHealthchecker().GetTLSConfig().ServerName; name != "dns.quad9.net" {
+		t.Errorf("expected server name from the stamp, got %s", name)
+	}
+
+	d, ok := f.proxies[1].(*dohProxy)
+	if !ok || d.Addr() != "1.1.1.1:443" || d.url != "https://cloudflare-dns.com/dns-query" || d.method != http.MethodPost {
+		t.Fatalf("unexpected DoH upstream %+v", f.proxies[1])
+	}
+	if name := d.transport.TLSClientConfig.ServerName; name != "cloudflare-dns.com" {
+		t.Errorf("expected server name from the stamp, got %s", name)
+	}
+
+	if name := f.tlsConfig.ServerName; name != "example.org" {
+		t.Errorf("expected tls_servername to still apply to the other upstreams, got %s", name)
+	}
+}
@@ -9,7 +9,8 @@ type TrieNode struct {
 	Current  string
 	Children map[string]*TrieNode
 
-	End bool
+	End     bool // domain and its subdomains match
+	Exclude bool // domain and its subdomains are excluded, wins over any shorter End
 }
 
 func makeSegments(domain string) []string {
@@ -41,13 +42,26 @@ func InsertDomain(domain string, root *TrieNode) *TrieNode {
 	return root
 }
 
+// ExcludeDomain marks domain and its subdomains as excluded, creating root if needed.
+func ExcludeDomain(domain string, root *TrieNode) *TrieNode {
+	segments := makeSegments(domain)
+
+	if root == nil {
+		root = &TrieNode{Current: "."}
+	}
+	walk(segments, root).Exclude = true
+
+	return root
+}
+
+// Insert marks segments as a matching suffix. Children are kept since they may hold longer exclusions.
 func Insert(segments []string, root *TrieNode) {
+	walk(segments, root).End = true
+}
+
+func walk(segments []string, root *TrieNode) *TrieNode {
 	current := root
 	for _, segment := range segments {
-		if current.End {
-			break
-		}
-
 		if next := current.Children[segment]; next != nil {
 			current = next
 			continue
@@ -61,34 +75,41 @@ func Insert(segments []string, root *TrieNode) {
 		current = current.Children[segment]
 	}
 
-	current.End = true
-	current.Children = nil
+	return current
 }
 
+// FindDomainSuffix returns the verdict of the longest suffix of domain found in the trie.
 func FindDomainSuffix(domain string, current *TrieNode) bool {
+	matched, _ := lookupDomainSuffix(domain, current)
+	return matched
+}
+
+// lookupDomainSuffix is FindDomainSuffix, found reports whether any suffix of domain is in the trie.
+func lookupDomainSuffix(domain string, current *TrieNode) (matched, found bool) {
 	if current == nil {
-		return false
-	}
-	if current.End {
-		return true
+		return false, false
 	}
 
-	segments := makeSegments(domain)
-	for _, segment := range segments {
-		if current == nil {
-			break
-		}
-
+	matched, found = verdict(current, false, false)
+	for _, segment := range makeSegments(domain) {
 		current = current.Children[segment]
 		if current == nil {
-			return false
-		}
-		if current.End {
-			return true
+			break
 		}
+		matched, found = verdict(current, matched, found)
 	}
 
-	return false
+	return matched, found
+}
+
+func verdict(current *TrieNode, matched, found bool) (bool, bool) {
+	switch {
+	case current.Exclude:
+		return false, true
+	case current.End:
+		return true, true
+	}
+	return matched, found
 }
 
 func Format(root *TrieNode) []string {
@@ -99,11 +120,15 @@ func dfs(current *TrieNode, domain string, results []string) []string {
 	if current == nil {
 		return nil
 	}
-	if current.End {
-		if domain == "" {
-			return append(results, ".")
+	if current.End || current.Exclude {
+		name := domain
+		if name == "" {
+			name = "."
+		}
+		if current.Exclude {
+			name = "!" + name
 		}
-		return append(results, domain)
+		results = append(results, name)
 	}
 
 	for prefix, next := range current.Children {
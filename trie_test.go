@@ -3,7 +3,11 @@ package pforward
 import (
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/coredns/caddy"
 )
 
 var tlds = []string{"com.", "net.", "org."}
@@ -67,3 +71,63 @@ func TestEdgeCase(t *testing.T) {
 		}
 	}
 }
+
+func TestExclude(t *testing.T) {
+	var root *TrieNode
+	root = InsertDomain("google.com.", root)
+	root = ExcludeDomain("mail.google.com.", root)
+	root = InsertDomain("inbox.mail.google.com.", root)
+	root = InsertDomain("www.google.com.", root)
+
+	tests := map[string]bool{
+		"google.com.":              true,
+		"www.google.com.":          true,
+		"mail.google.com.":         false,
+		"a.mail.google.com.":       false,
+		"inbox.mail.google.com.":   true,
+		"x.inbox.mail.google.com.": true,
+		"google.com.example.org.":  false,
+		"notgoogle.com.":           false,
+		"mail.google.com.example.": false,
+	}
+	for domain, expected := range tests {
+		if got := FindDomainSuffix(domain, root); got != expected {
+			t.Errorf("domain=%s expected=%v got=%v", domain, expected, got)
+		}
+	}
+
+	root = ExcludeDomain("google.com.", InsertDomain(".", nil))
+	if !FindDomainSuffix("example.org.", root) || FindDomainSuffix("www.google.com.", root) {
+		t.Errorf("unexpected verdict with root match, results=%+v", Format(root))
+	}
+}
+
+func TestRulesetExclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sub"), []byte("except:cn.google.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ruleset := "# test\ngoogle.com\n!mail.google.com\ninclude:sub\n"
+	if err := os.WriteFile(filepath.Join(dir, "rules"), []byte(ruleset), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "pforward "+filepath.Join(dir, "rules")+" 127.0.0.1 {\nexcept maps.google.com\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+
+	tests := map[string]bool{
+		"www.google.com.":  true,
+		"mail.google.com.": false,
+		"cn.google.com.":   false,
+		"maps.google.com.": false,
+		"example.org.":     false,
+	}
+	for domain, expected := range tests {
+		if got := fs[0].from.Load().Match(domain); got != expected {
+			t.Errorf("domain=%s expected=%v got=%v", domain, expected, got)
+		}
+	}
+}
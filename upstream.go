@@ -0,0 +1,97 @@
+package pforward
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/up"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Upstream is an upstream server. *proxy.Proxy implements it for dns:// and tls://, the other transports
+// implement it here.
+type Upstream interface {
+	Addr() string
+	Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error)
+	Healthcheck()
+	Down(maxfails uint32) bool
+	Start(hcInterval time.Duration)
+	Stop()
+	SetReadTimeout(d time.Duration)
+}
+
+const defaultReadTimeout = 2 * time.Second
+
+// upstreamHealth keeps the health of the upstreams we implement, like proxy.Proxy does: a probe sends
+// "<domain> IN NS" until the upstream replies, and every failed probe counts towards max_fails.
+type upstreamHealth struct {
+	fails            uint32
+	probe            *up.Probe
+	domain           string
+	recursionDesired bool
+	tcp              bool // probe over TCP where the upstream has a choice, as force_tcp does for proxy.Proxy
+}
+
+func newUpstreamHealth() upstreamHealth {
+	return upstreamHealth{probe: up.New(), domain: ".", recursionDesired: true}
+}
+
+// Down returns true if the upstream has *more* fails than maxfails.
+func (h *upstreamHealth) Down(maxfails uint32) bool {
+	if maxfails == 0 {
+		return false
+	}
+	return atomic.LoadUint32(&h.fails) > maxfails
+}
+
+// healthcheck kicks off a round of health checks sending the probe with exchange.
+func (h *upstreamHealth) healthcheck(exchange func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)) {
+	h.probe.Do(func() error {
+		ping := new(dns.Msg)
+		ping.SetQuestion(h.domain, dns.TypeNS)
+		ping.RecursionDesired = h.recursionDesired
+
+		// any reply is fine, we only care about transport errors
+		if _, err := exchange(context.Background(), ping); err != nil {
+			atomic.AddUint32(&h.fails, 1)
+			return err
+		}
+		atomic.StoreUint32(&h.fails, 0)
+		return nil
+	})
+}
+
+// connectAbandon queries p until ctx is done. proxy.Proxy ignores ctx and waits for its read timeout, so
+// its attempt, or the one of a hostname upstream which may use one, is abandoned when ctx is done: it still
+// ends at the read timeout, which also closes the conn, but the caller returns right away. state must be
+// the caller's own copy, the abandoned attempt may still rewrite the message id.
+func connectAbandon(ctx context.Context, p Upstream, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	switch p.(type) {
+	case *proxy.Proxy, *hostProxy:
+	default:
+		return p.Connect(ctx, state, opts)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		ret *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ret, err := p.Connect(ctx, state, opts)
+		done <- result{ret, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.ret, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
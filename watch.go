@@ -0,0 +1,275 @@
+package pforward
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	defaultReload  = time.Minute
+	reloadDebounce = 500 * time.Millisecond
+)
+
+// rulesetFiles maps every file of a ruleset, the root and its includes, to the hash of its content.
+type rulesetFiles map[string][sha256.Size]byte
+
+func (files rulesetFiles) paths() []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (files rulesetFiles) digest() [sha256.Size]byte {
+	h := sha256.New()
+	for _, path := range files.paths() {
+		sum := files[path]
+		h.Write([]byte(path))
+		h.Write(sum[:])
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// fileWatcher reloads a file when it or any of its includes changes on disk, and every interval in case
+// filesystem events are missed or unavailable. Events are debounced, and a reload with unchanged content
+// does not store anything.
+type fileWatcher[T any] struct {
+	path     string
+	kind     string        // what the file holds, for logging
+	interval time.Duration // interval=0: filesystem events only
+	read     func(path string, files rulesetFiles) (T, error)
+	store    func(T) error
+	stale    func() bool // nil: never, reports whether the last read served an outdated copy
+
+	mu     sync.Mutex
+	digest [sha256.Size]byte
+	files  []string // absolute paths read on the last successful reload
+
+	stopped chan struct{} // nil when not running
+	done    sync.WaitGroup
+}
+
+// rulesetWatcher reloads a ruleset, the matcher is only rebuilt when its content changed.
+type rulesetWatcher = fileWatcher[[]Rule]
+
+func newRulesetWatcher(path string, store func([]Rule) error) *rulesetWatcher {
+	return &rulesetWatcher{path: path, kind: "domains", interval: defaultReload, read: rulesetReader(formatAuto), store: store}
+}
+
+// rulesetReader returns the read function of a rulesetWatcher for rulesets in format, or geosite.dat.
+func rulesetReader(format rulesetFormat) func(path string, files rulesetFiles) ([]Rule, error) {
+	return func(path string, files rulesetFiles) ([]Rule, error) {
+		var rules []Rule
+		var err error
+		if spec, ok := strings.CutPrefix(path, geositePrefix); ok {
+			rules, err = readGeosite(spec, files)
+		} else {
+			rules, err = readRulesetFiles(path, format, files)
+		}
+		if len(rules) == 0 || err != nil {
+			return nil, fmt.Errorf("unable to normalize '%s' '%v'", path, err)
+		}
+		return rules, nil
+	}
+}
+
+// reload reads the file and stores it when its content changed since the last successful reload.
+func (w *fileWatcher[T]) reload() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := rulesetFiles{}
+	v, err := w.read(w.path, files)
+	if err != nil {
+		return false, err
+	}
+
+	digest := files.digest()
+	if digest == w.digest {
+		return false, nil
+	}
+	if err := w.store(v); err != nil {
+		return false, err
+	}
+
+	w.digest = digest
+	w.files = w.files[:0]
+	for _, path := range files.paths() {
+		if isRemote(path) {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		w.files = append(w.files, path)
+	}
+
+	return true, nil
+}
+
+func (w *fileWatcher[T]) isStale() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stale != nil && w.stale()
+}
+
+func (w *fileWatcher[T]) watched() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.files...)
+}
+
+// start starts watching in a new goroutine, it is a no-op when already running.
+func (w *fileWatcher[T]) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped != nil {
+		return
+	}
+
+	w.stopped = make(chan struct{})
+	w.done.Add(1)
+	go func(stop <-chan struct{}) {
+		defer w.done.Done()
+		w.run(stop)
+	}(w.stopped)
+}
+
+// stop stops watching and waits for the goroutine to exit.
+func (w *fileWatcher[T]) stop() {
+	w.mu.Lock()
+	if w.stopped != nil {
+		close(w.stopped)
+		w.stopped = nil
+	}
+	w.mu.Unlock()
+
+	w.done.Wait()
+}
+
+// run watches the file until stop is closed.
+func (w *fileWatcher[T]) run(stop <-chan struct{}) {
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+		tick   <-chan time.Time
+	)
+
+	// remote files are only polled
+	var fw *fsnotify.Watcher
+	if !isRemote(w.path) {
+		var err error
+		if fw, err = fsnotify.NewWatcher(); err != nil {
+			log.Warningf("unable to watch %s '%s', fall back to polling: %v", w.kind, w.path, err)
+		} else {
+			defer fw.Close()
+			events, errs = fw.Events, fw.Errors
+		}
+	}
+
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Directories are watched rather than files, so files replaced by rename (editors, git) are still seen.
+	dirs := make(map[string]bool)
+	w.watch(fw, dirs)
+
+	// an outdated copy served at startup is refreshed right away instead of after the first interval
+	if w.isStale() {
+		w.update(fw, dirs)
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if w.contains(event.Name) {
+				pending = time.After(reloadDebounce)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Warningf("watch %s '%s' err=%v", w.kind, w.path, err)
+		case <-pending:
+			pending = nil
+			w.update(fw, dirs)
+		case <-tick:
+			w.update(fw, dirs)
+		}
+	}
+}
+
+func (w *fileWatcher[T]) update(fw *fsnotify.Watcher, dirs map[string]bool) {
+	changed, err := w.reload()
+	if err != nil {
+		log.Errorf("update %s err=%v", w.kind, err)
+		return
+	}
+	if changed {
+		log.Infof("update %s path=%s files=%d", w.kind, w.path, len(w.watched()))
+		w.watch(fw, dirs)
+	}
+}
+
+// watch syncs the watched directories with the include graph of the last reload.
+func (w *fileWatcher[T]) watch(fw *fsnotify.Watcher, dirs map[string]bool) {
+	if fw == nil {
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, path := range w.watched() {
+		wanted[filepath.Dir(path)] = true
+	}
+	for dir := range wanted {
+		if dirs[dir] {
+			continue
+		}
+		if err := fw.Add(dir); err != nil {
+			log.Warningf("unable to watch '%s': %v", dir, err)
+			continue
+		}
+		dirs[dir] = true
+	}
+	for dir := range dirs {
+		if !wanted[dir] {
+			fw.Remove(dir)
+			delete(dirs, dir)
+		}
+	}
+}
+
+func (w *fileWatcher[T]) contains(name string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	for _, path := range w.watched() {
+		if path == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package pforward
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestRulesetWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules")
+	if err := os.WriteFile(path, []byte("google.com\ninclude:sub/local\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "local"), []byte("youtube.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	builds := 0
+	w := newRulesetWatcher(path, func([]Rule) error { builds++; return nil })
+	if changed, err := w.reload(); !changed || err != nil {
+		t.Fatalf("expected first reload to build, changed=%v err=%v", changed, err)
+	}
+	if changed, err := w.reload(); changed || err != nil {
+		t.Fatalf("expected unchanged reload to be skipped, changed=%v err=%v", changed, err)
+	}
+	if len(w.watched()) != 2 {
+		t.Errorf("expected root and include to be watched, got %v", w.watched())
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", "local"), []byte("youtube.com\nnetflix.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := w.reload(); !changed || err != nil {
+		t.Fatalf("expected changed include to build, changed=%v err=%v", changed, err)
+	}
+	if builds != 2 {
+		t.Errorf("expected 2 builds, got %d", builds)
+	}
+}
+
+func TestRulesetWatcherEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules")
+	if err := os.WriteFile(path, []byte("google.com\ninclude:local\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "local"), []byte("youtube.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "pforward "+path+" 127.0.0.1 {\nreload 0\n}")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	if f.watcher.interval != 0 {
+		t.Fatalf("expected reload interval 0, got %s", f.watcher.interval)
+	}
+
+	f.OnStartup()
+	defer f.OnShutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	// replace the include by rename, as editors and git do
+	tmp := filepath.Join(dir, "local.tmp")
+	if err := os.WriteFile(tmp, []byte("netflix.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "local")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !f.from.Load().Match("netflix.com.") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected include change to be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if f.from.Load().Match("youtube.com.") {
+		t.Error("expected youtube.com to be removed")
+	}
+}
+
+func TestRulesetWatcherLeak(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(path, []byte("google.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cycle := func() {
+		c := caddy.NewTestController("dns", "pforward "+path+" 127.0.0.1")
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Failed to create forwarder: %s", err)
+		}
+		fs[0].OnStartup()
+		fs[0].OnShutdown()
+	}
+
+	cycle() // warm up lazily started goroutines
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		cycle()
+	}
+
+	// proxy transports are only stopped by their finalizer
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines after 20 setup/teardown cycles, got %d", before, runtime.NumGoroutine())
+		}
+		runtime.GC()
+		time.Sleep(50 * time.Millisecond)
+	}
+}